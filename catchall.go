@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// modes of the --catchAll flag
+const (
+	catchAllOff    = "off"
+	catchAllLabels = "labels"
+	catchAllNames  = "names"
+)
+
+var (
+	// in "labels" mode all remaining stats end up in these two families
+	catchAllGauge = prometheus.NewDesc(
+		"kamailio_stat",
+		"Kamailio stat not covered by the mappings",
+		[]string{"group", "name"}, nil)
+
+	catchAllCounter = prometheus.NewDesc(
+		"kamailio_stat_total",
+		"Kamailio counter stat not covered by the mappings",
+		[]string{"group", "name"}, nil)
+
+	invalidMetricCharsRegexp = regexp.MustCompile(`[^a-z0-9_]+`)
+
+	// stat names containing one of these are most likely counters,
+	// used for stats missing in the known stats registry
+	counterStatHints = []string{"_total", "replies", "requests", "_regs", "rcvd", "received", "sent", "failed", "dropped", "errors"}
+)
+
+// Export every stat which is not covered by the mappings or the scripted metrics.
+// Depending on the mode this produces kamailio_stat{group,name} or kamailio_<group>_<name> series.
+func convertRemainingStats(s *scrape, mode string, mappings []*metricMapping, scriptedGroups map[string]*scriptedGroupConfig, completeStatMap map[string]string, metricChannel chan<- prometheus.Metric) {
+	if mode == catchAllOff {
+		return
+	}
+
+	// iterate in a stable order, the first stat wins if two names collide
+	var keys []string
+	for key := range completeStatMap {
+		// stats of disabled collectors are not exported either
+		if !s.exported[key] && scriptedGroupOf(scriptedGroups, key) == nil && !isMappedStat(mappings, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	// the names already taken by the mappings and the scripted metrics
+	names := make(map[string]string)
+	for name, producer := range s.names {
+		names[name] = producer
+	}
+	for _, mapping := range mappings {
+		names[mapping.name] = "mapping " + mapping.name
+	}
+
+	for _, key := range keys {
+		group, name := splitStatKey(key)
+		known := inferStat(key)
+		valueType := known.valueType
+
+		if mode == catchAllLabels {
+			description := catchAllGauge
+			if valueType == prometheus.CounterValue {
+				description = catchAllCounter
+			}
+			convertStatToLabelledMetric(s, completeStatMap, key, []string{group, name}, description, metricChannel, valueType)
+			continue
+		}
+
+		metricName := "kamailio_" + sanitizeMetricName(group+"_"+name)
+		if known.unit != "" && !strings.HasSuffix(metricName, "_"+known.unit) {
+			metricName += "_" + known.unit
+		}
+		if valueType == prometheus.CounterValue && !strings.HasSuffix(metricName, "_total") {
+			metricName += "_total"
+		}
+		if other, ok := names[metricName]; ok {
+			warnLimiter.Warnf(s.log, "catchall:"+key, "Skipping stat value [%s], metric name %s is already used by %s", key, metricName, other)
+			continue
+		}
+		names[metricName] = "stat " + key
+		description := prometheus.NewDesc(metricName, known.help, []string{}, nil)
+		convertStatToMetric(s, completeStatMap, key, "", description, metricChannel, valueType)
+	}
+}
+
+// "usrloc.location-contacts" => "usrloc", "location-contacts"
+func splitStatKey(key string) (string, string) {
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// the semantic of a stat, taken from the known stats or guessed by its name
+func inferStat(key string) knownStat {
+	if known, ok := lookupKnownStat(key); ok {
+		return known
+	}
+	name := strings.ToLower(key)
+	for _, hint := range counterStatHints {
+		if strings.Contains(name, hint) {
+			return counterStat("Kamailio stat " + key)
+		}
+	}
+	return gaugeStat("", "Kamailio stat "+key)
+}
+
+// turn anything into a valid prometheus metric name (without the "kamailio_" prefix)
+func sanitizeMetricName(name string) string {
+	name = invalidMetricCharsRegexp.ReplaceAllString(strings.ToLower(name), "_")
+	return strings.Trim(name, "_")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestConvertRemainingStats(t *testing.T) {
+	mapping, err := newMetricMapping(metricMappingConfig{Name: "kamailio_sl_sent_replies_total", Help: "Stateless failures", Stats: []statMappingConfig{{Key: "sl.failures"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]string{
+		// covered by the mapping, the scripted metrics or already exported
+		"sl.failures":   "1",
+		"script.calls":  "2",
+		"core.exported": "3",
+		// known and unknown stats
+		"shmem.free_size":  "4",
+		"sl.sent_replies":  "5",
+		"app.sent_invites": "6",
+		"app.Active-Calls": "7",
+		"app.active_calls": "8",
+	}
+	tests := []struct {
+		mode string
+		// the series by metric name and type
+		series map[string][]string
+	}{
+		{catchAllOff, map[string][]string{}},
+		{catchAllLabels, map[string][]string{
+			"kamailio_stat GAUGE":         {"app/Active-Calls 7", "app/active_calls 8", "shmem/free_size 4"},
+			"kamailio_stat_total COUNTER": {"app/sent_invites 6", "sl/sent_replies 5"},
+		}},
+		{catchAllNames, map[string][]string{
+			// the first stat wins, sl.sent_replies collides with the mapping
+			"kamailio_app_active_calls GAUGE":         {"7"},
+			"kamailio_app_sent_invites_total COUNTER": {"6"},
+			"kamailio_shmem_free_size_bytes GAUGE":    {"4"},
+		}},
+	}
+	for _, test := range tests {
+		families := gatherFamilies(t, func(metricChannel chan<- prometheus.Metric) {
+			s := newTestScrape()
+			s.exported["core.exported"] = true
+			convertRemainingStats(s, test.mode, []*metricMapping{mapping}, defaultScriptedGroups(), data, metricChannel)
+		})
+		series := make(map[string][]string)
+		for _, family := range families {
+			name := family.GetName() + " " + family.GetType().String()
+			for _, metric := range family.Metric {
+				var labels []string
+				for _, label := range metric.Label {
+					labels = append(labels, label.GetValue())
+				}
+				value := metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+				sample := strings.TrimSpace(strings.Join(labels, "/") + " " + strconv.FormatFloat(value, 'g', -1, 64))
+				series[name] = append(series[name], sample)
+			}
+			sort.Strings(series[name])
+		}
+		if !reflect.DeepEqual(series, test.series) {
+			t.Errorf("%s: got %v, want %v", test.mode, series, test.series)
+		}
+	}
+}
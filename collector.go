@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// a group of metrics which can be enabled or disabled with --collector.<name>
+type Collector interface {
+	// produce the metrics of this collector for a single scrape
+	Update(s *scrape, metricChannel chan<- prometheus.Metric) error
+}
+
+// everything a collector may need to set itself up
+type collectorConfig struct {
+	cliContext *cli.Context
+	settings   *exporterSettings
+	mappings   []*metricMapping
+}
+
+type collectorFactory func(config *collectorConfig) (Collector, error)
+
+type registeredCollector struct {
+	name             string
+	isDefaultEnabled bool
+	factory          collectorFactory
+	// whether it produces the metrics of the mapping file
+	isMapping bool
+}
+
+var (
+	// all known collectors in the order they run during a scrape
+	collectorRegistry []registeredCollector
+
+	collectorEnabled = prometheus.NewDesc(
+		"kamailio_exporter_collector_enabled",
+		"Whether a collector is enabled",
+		[]string{"collector"}, nil)
+)
+
+// make a collector known, must be called before the cli flags are created
+func registerCollector(name string, isDefaultEnabled bool, factory collectorFactory) {
+	collectorRegistry = append(collectorRegistry, registeredCollector{name, isDefaultEnabled, factory, false})
+}
+
+// make a collector of the mapping file known, it produces the metrics of mappings with the same "collector"
+func registerMappingCollector(name string, isDefaultEnabled bool) {
+	collectorRegistry = append(collectorRegistry, registeredCollector{name, isDefaultEnabled, newMappingCollector(name), true})
+}
+
+func init() {
+	// collectors of the mapping file, each one produces the metrics of mappings with the same "collector"
+	registerMappingCollector("core", true)
+	registerMappingCollector("shmem", true)
+	registerMappingCollector("sl", true)
+	registerMappingCollector("tcp", true)
+	registerMappingCollector("tmx", true)
+	registerMappingCollector("dialog", true)
+	registerMappingCollector("registrar", true)
+	registerMappingCollector("usrloc", true)
+	// user-defined stats of the kamailio script
+	registerCollector("scripted", true, newScriptedCollector)
+	// entries of the htables of the config file
+	registerCollector("htable", true, newHtableCollector)
+	// shared variables ($shv) of the config file
+	registerCollector("shv", true, newShvCollector)
+	// observations posted to the push endpoint of the config file
+	registerCollector("push", true, newPushCollector)
+	// events of the evapi connection of the config file
+	registerCollector("evapi", true, newEvapiCollector)
+	// samples of the statsd listener of the config file
+	registerCollector("statsd", true, newStatsdCollector)
+}
+
+// check wether a collector with this name exists
+func isRegisteredCollector(name string) bool {
+	for _, registered := range collectorRegistry {
+		if registered.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// check wether a collector with this name produces the metrics of the mapping file
+func isMappingCollector(name string) bool {
+	for _, registered := range collectorRegistry {
+		if registered.name == name && registered.isMapping {
+			return true
+		}
+	}
+	return false
+}
+
+// names of all registered collectors
+func registeredCollectorNames() []string {
+	var names []string
+	for _, registered := range collectorRegistry {
+		names = append(names, registered.name)
+	}
+	return names
+}
+
+// names of the collectors of the mapping file
+func mappingCollectorNames() []string {
+	var names []string
+	for _, registered := range collectorRegistry {
+		if registered.isMapping {
+			names = append(names, registered.name)
+		}
+	}
+	return names
+}
+
+// a --collector.<name> and --no-collector.<name> flag for each registered collector
+func collectorFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, registered := range collectorRegistry {
+		state := "disabled"
+		if registered.isDefaultEnabled {
+			state = "enabled"
+		}
+		envName := strings.ToUpper(registered.name)
+		flags = append(flags,
+			cli.BoolFlag{
+				Name:   "collector." + registered.name,
+				Usage:  fmt.Sprintf("Enable the %s collector (default: %s)", registered.name, state),
+				EnvVar: "COLLECTOR_" + envName,
+			},
+			cli.BoolFlag{
+				Name:   "no-collector." + registered.name,
+				Usage:  fmt.Sprintf("Disable the %s collector", registered.name),
+				EnvVar: "NO_COLLECTOR_" + envName,
+			})
+	}
+	return flags
+}
+
+// the enabled state of every registered collector, according to the cli flags
+func enabledCollectors(cliContext *cli.Context) map[string]bool {
+	enabled := make(map[string]bool)
+	for _, registered := range collectorRegistry {
+		switch {
+		case cliContext.Bool("no-collector." + registered.name):
+			enabled[registered.name] = false
+		case cliContext.Bool("collector." + registered.name):
+			enabled[registered.name] = true
+		default:
+			enabled[registered.name] = registered.isDefaultEnabled
+		}
+	}
+	return enabled
+}
+
+// an enabled collector, ready to be used for each scrape
+type namedCollector struct {
+	name      string
+	collector Collector
+}
+
+// create all enabled collectors, in registry order
+func newCollectors(config *collectorConfig, enabled map[string]bool) ([]namedCollector, error) {
+	var collectors []namedCollector
+	for _, registered := range collectorRegistry {
+		if !enabled[registered.name] {
+			continue
+		}
+		collector, err := registered.factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("collector %s: %s", registered.name, err)
+		}
+		collectors = append(collectors, namedCollector{registered.name, collector})
+	}
+	return collectors, nil
+}
+
+// produce a kamailio_exporter_collector_enabled metric for each registered collector
+func produceCollectorEnabledMetrics(enabled map[string]bool, metricChannel chan<- prometheus.Metric) {
+	for _, registered := range collectorRegistry {
+		value := 0.0
+		if enabled[registered.name] {
+			value = 1
+		}
+		metricChannel <- prometheus.MustNewConstMetric(collectorEnabled, prometheus.GaugeValue, value, registered.name)
+	}
+}
+
+// a collector producing the metrics of the mapping file which belong to it
+type mappingCollector struct {
+	mappings []*metricMapping
+}
+
+func newMappingCollector(name string) collectorFactory {
+	return func(config *collectorConfig) (Collector, error) {
+		collector := &mappingCollector{}
+		for _, mapping := range config.mappings {
+			if mapping.collector == name {
+				collector.mappings = append(collector.mappings, mapping)
+			}
+		}
+		return collector, nil
+	}
+}
+
+func (c *mappingCollector) Update(s *scrape, metricChannel chan<- prometheus.Metric) error {
+	completeStatMap, err := s.statMap()
+	if err != nil {
+		return err
+	}
+	produceMetrics(s, c.mappings, completeStatMap, metricChannel)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	_ "embed"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// modes of the --metrics.compat flag
+const (
+	compatNone    = "none"
+	compatFlorent = "florent"
+)
+
+// mappings producing the metric names of github.com/florentchauveau/kamailio_exporter
+//
+//go:embed mappings_florent.yml
+var florentMappings []byte
+
+var (
+	// the scrape metrics of the florentchauveau exporter
+	florentUp = prometheus.NewDesc(
+		"kamailio_up",
+		"Was the last scrape of kamailio successful.",
+		nil, nil)
+
+	florentTotalScrapes = prometheus.NewDesc(
+		"kamailio_exporter_total_scrapes",
+		"Current total kamailio scrapes.",
+		nil, nil)
+
+	florentFailedScrapes = prometheus.NewDesc(
+		"kamailio_exporter_failed_scrapes",
+		"Number of failed kamailio scrapes.",
+		nil, nil)
+)
+
+// scrape counters, shared by concurrent scrapes
+type scrapeCounters struct {
+	total  uint64
+	failed uint64
+}
+
+// produce the kamailio_up and scrape counter metrics of the florentchauveau exporter
+func produceFlorentScrapeMetrics(s *scrape, counters *scrapeCounters, metricChannel chan<- prometheus.Metric) {
+	total := atomic.AddUint64(&counters.total, 1)
+	failed := atomic.LoadUint64(&counters.failed)
+	up := 1.0
+	if _, err := s.statMap(); err != nil {
+		failed = atomic.AddUint64(&counters.failed, 1)
+		up = 0
+	}
+	metricChannel <- prometheus.MustNewConstMetric(florentUp, prometheus.GaugeValue, up)
+	metricChannel <- prometheus.MustNewConstMetric(florentTotalScrapes, prometheus.CounterValue, float64(total))
+	metricChannel <- prometheus.MustNewConstMetric(florentFailedScrapes, prometheus.CounterValue, float64(failed))
+}
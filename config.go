@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// the optional exporter configuration file, see --configFile
+type exporterConfig struct {
+	// the kamailio to scrape, overrides --host, --port and --socketPath
+	Target *targetConfig `yaml:"target"`
+	// overrides --mappingFile
+	MappingFile string `yaml:"mapping_file"`
+	// enables or disables collectors, overrides --collector.<name> and --no-collector.<name>
+	Collectors map[string]bool `yaml:"collectors"`
+	// applied to all metrics before they are exposed
+	MetricRelabelConfigs []*relabelConfig `yaml:"metric_relabel_configs"`
+	// extra http endpoints serving the metrics of some collectors
+	Endpoints []*endpointConfig `yaml:"endpoints"`
+	// series limits of single collectors, they win over --series.collectorLimit
+	SeriesLimits map[string]int `yaml:"series_limits"`
+	// type, help, unit and name of scripted metrics, by their metric name without "kamailio_"
+	ScriptedMetrics map[string]*scriptedMetricConfig `yaml:"scripted_metrics"`
+	// further stat groups exported like the "script." stats
+	ScriptedGroups []*scriptedGroupConfig `yaml:"scripted_groups"`
+	// htables whose entries are exported by the htable collector
+	Htables []*htableConfig `yaml:"htables"`
+	// names of the shared variables ($shv) exported by the shv collector
+	SharedVariables []string `yaml:"shared_variables"`
+	// an http endpoint accepting observations of the kamailio script
+	Push *pushConfig `yaml:"push"`
+	// a connection to the evapi module of kamailio, its events are turned into metrics
+	Evapi *evapiConfig `yaml:"evapi"`
+	// a udp listener receiving the samples of kamailio's statsd module
+	Statsd *statsdConfig `yaml:"statsd"`
+}
+
+// where to reach kamailio, the domain socket is used if no host is defined
+type targetConfig struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	SocketPath string `yaml:"socket_path"`
+}
+
+// an extra http endpoint, e.g. /metrics/core
+type endpointConfig struct {
+	Path       string   `yaml:"path"`
+	Collectors []string `yaml:"collectors"`
+	// responses are cached this long, 0 disables the cache
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// the validated configuration, ready to be used
+type exporterSettings struct {
+	target          *targetConfig
+	mappingFile     string
+	collectors      map[string]bool
+	relabelRules    []*relabelRule
+	endpoints       []*endpointConfig
+	seriesLimits    map[string]int
+	scriptedMetrics map[string]*scriptedMetricConfig
+	// by group name, always includes the "script" group
+	scriptedGroups  map[string]*scriptedGroupConfig
+	htables         []*htableMetric
+	sharedVariables []string
+	push            *pushConfig
+	evapi           *evapiConfig
+	statsd          *statsdConfig
+}
+
+// load and validate the config file, an empty fileName results in the defaults
+func loadConfig(fileName string) (*exporterSettings, error) {
+	settings := &exporterSettings{scriptedGroups: defaultScriptedGroups()}
+	if fileName == "" {
+		return settings, nil
+	}
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config exporterConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+
+	if config.Target != nil && config.Target.Host != "" && config.Target.Port == 0 {
+		return nil, fmt.Errorf("%s: target: port is missing", fileName)
+	}
+	settings.target = config.Target
+	settings.mappingFile = config.MappingFile
+	for name := range config.Collectors {
+		if !isRegisteredCollector(name) {
+			return nil, fmt.Errorf("%s: collectors: unknown collector %q, use one of %s", fileName, name, strings.Join(registeredCollectorNames(), ", "))
+		}
+	}
+	settings.collectors = config.Collectors
+
+	for i, relabelConfig := range config.MetricRelabelConfigs {
+		rule, err := newRelabelRule(relabelConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: metric_relabel_configs #%d: %s", fileName, i+1, err)
+		}
+		settings.relabelRules = append(settings.relabelRules, rule)
+	}
+
+	paths := make(map[string]bool)
+	for i, endpoint := range config.Endpoints {
+		if err := checkEndpoint(endpoint); err != nil {
+			return nil, fmt.Errorf("%s: endpoints #%d: %s", fileName, i+1, err)
+		}
+		if paths[endpoint.Path] {
+			return nil, fmt.Errorf("%s: endpoints #%d: path %s is used more than once", fileName, i+1, endpoint.Path)
+		}
+		paths[endpoint.Path] = true
+		settings.endpoints = append(settings.endpoints, endpoint)
+	}
+	// validated together with the flags
+	settings.seriesLimits = config.SeriesLimits
+
+	for name, scripted := range config.ScriptedMetrics {
+		if err := checkScriptedMetricConfig(scripted); err != nil {
+			return nil, fmt.Errorf("%s: scripted_metrics: %s: %s", fileName, name, err)
+		}
+	}
+	settings.scriptedMetrics = config.ScriptedMetrics
+
+	groups := make(map[string]bool)
+	for i, group := range config.ScriptedGroups {
+		if err := checkScriptedGroupConfig(group); err != nil {
+			return nil, fmt.Errorf("%s: scripted_groups #%d: %s", fileName, i+1, err)
+		}
+		if groups[group.Group] {
+			return nil, fmt.Errorf("%s: scripted_groups #%d: group %s is declared more than once", fileName, i+1, group.Group)
+		}
+		groups[group.Group] = true
+		// a declared "script" group replaces the default one
+		settings.scriptedGroups[group.Group] = group
+	}
+
+	names := make(map[string]bool)
+	for i, htable := range config.Htables {
+		metric, err := newHtableMetric(htable)
+		if err != nil {
+			return nil, fmt.Errorf("%s: htables #%d: %s", fileName, i+1, err)
+		}
+		if names[metric.name] {
+			return nil, fmt.Errorf("%s: htables #%d: metric %s is used more than once", fileName, i+1, metric.name)
+		}
+		names[metric.name] = true
+		settings.htables = append(settings.htables, metric)
+	}
+
+	variables := make(map[string]bool)
+	for _, name := range config.SharedVariables {
+		if name == "" {
+			return nil, fmt.Errorf("%s: shared_variables: empty name", fileName)
+		}
+		if variables[name] {
+			return nil, fmt.Errorf("%s: shared_variables: %s is declared more than once", fileName, name)
+		}
+		variables[name] = true
+	}
+	settings.sharedVariables = config.SharedVariables
+
+	if config.Push != nil {
+		if err := checkPushConfig(config.Push); err != nil {
+			return nil, fmt.Errorf("%s: push: %s", fileName, err)
+		}
+		if paths[config.Push.Path] {
+			return nil, fmt.Errorf("%s: push: path %s is already used by an endpoint", fileName, config.Push.Path)
+		}
+	}
+	settings.push = config.Push
+
+	if config.Evapi != nil {
+		if err := checkEvapiConfig(config.Evapi); err != nil {
+			return nil, fmt.Errorf("%s: evapi: %s", fileName, err)
+		}
+		for name := range config.Evapi.Metrics {
+			if config.Push != nil && config.Push.Metrics[name] != nil {
+				return nil, fmt.Errorf("%s: evapi: metrics: %s is already declared for the push endpoint", fileName, name)
+			}
+		}
+	}
+	settings.evapi = config.Evapi
+
+	if config.Statsd != nil {
+		if err := checkStatsdConfig(config.Statsd); err != nil {
+			return nil, fmt.Errorf("%s: statsd: %s", fileName, err)
+		}
+	}
+	settings.statsd = config.Statsd
+	return settings, nil
+}
+
+func checkEndpoint(endpoint *endpointConfig) error {
+	if !strings.HasPrefix(endpoint.Path, "/") || endpoint.Path == "/" || strings.HasPrefix(endpoint.Path, "/-/") {
+		return fmt.Errorf("invalid path %q", endpoint.Path)
+	}
+	if len(endpoint.Collectors) == 0 {
+		return fmt.Errorf("no collectors declared for %s", endpoint.Path)
+	}
+	for _, name := range endpoint.Collectors {
+		if !isRegisteredCollector(name) {
+			return fmt.Errorf("unknown collector %q, use one of %s", name, strings.Join(registeredCollectorNames(), ", "))
+		}
+	}
+	if endpoint.CacheTTL < 0 {
+		return fmt.Errorf("cache_ttl of %s is negative", endpoint.Path)
+	}
+	return nil
+}
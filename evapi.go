@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// the evapi endpoint of kamailio and the rules turning its events into metrics, declared in the config file
+// See https://www.kamailio.org/docs/modules/5.2.x/modules/evapi.html
+type evapiConfig struct {
+	// host:port of evapi_bind
+	Address string `yaml:"address"`
+	// netstring (evapi's netstring_format=1, the default) or lines (one event per line)
+	Format string `yaml:"format"`
+	// the time between connection attempts, 5s if omitted
+	ReconnectInterval time.Duration `yaml:"reconnect_interval"`
+	// by metric name without "kamailio_", like the metrics of the push endpoint
+	Metrics map[string]*pushMetricConfig `yaml:"metrics"`
+	Rules   []*evapiRule                 `yaml:"rules"`
+}
+
+// turns matching events into an observation of a metric
+type evapiRule struct {
+	// fields and their values an event must have, e.g. {event: call_end}
+	Match map[string]string `yaml:"match"`
+	// a metric of the metrics section
+	Metric string `yaml:"metric"`
+	// label names and the fields with their values
+	Labels map[string]string `yaml:"labels"`
+	// the field with the value, see pushObservation.Value
+	Value string `yaml:"value"`
+}
+
+// event formats
+const (
+	evapiNetstring = "netstring"
+	evapiLines     = "lines"
+)
+
+const defaultEvapiReconnectInterval = 5 * time.Second
+
+// events are limited to this size, like the observations of the push endpoint
+const maxEvapiEventSize = 1 << 20
+
+// results of kamailio_exporter_evapi_events_total
+const (
+	evapiMatched   = "matched"
+	evapiUnmatched = "unmatched"
+	evapiInvalid   = "invalid"
+)
+
+var (
+	evapiConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kamailio_exporter_evapi_connected",
+		Help: "Whether the exporter is connected to the evapi endpoint",
+	})
+
+	evapiEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kamailio_exporter_evapi_events_total",
+		Help: "Events received from the evapi endpoint, by whether a rule matched them",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(evapiConnected, evapiEvents)
+}
+
+func checkEvapiConfig(config *evapiConfig) error {
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %s", config.Address, err)
+	}
+	switch config.Format {
+	case "":
+		config.Format = evapiNetstring
+	case evapiNetstring, evapiLines:
+	default:
+		return fmt.Errorf("unknown format %q, use one of netstring or lines", config.Format)
+	}
+	if config.ReconnectInterval == 0 {
+		config.ReconnectInterval = defaultEvapiReconnectInterval
+	}
+	if config.ReconnectInterval < 0 {
+		return fmt.Errorf("reconnect_interval must not be negative")
+	}
+	for name, metric := range config.Metrics {
+		if err := checkPushMetricConfig(name, metric); err != nil {
+			return fmt.Errorf("metrics: %s: %s", name, err)
+		}
+	}
+	for i, rule := range config.Rules {
+		if err := checkEvapiRule(rule, config.Metrics); err != nil {
+			return fmt.Errorf("rules #%d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func checkEvapiRule(rule *evapiRule, metrics map[string]*pushMetricConfig) error {
+	metric, ok := metrics[rule.Metric]
+	if !ok {
+		return fmt.Errorf("metric %q is not declared", rule.Metric)
+	}
+	if len(rule.Labels) != len(metric.Labels) {
+		return fmt.Errorf("metric %s expects the labels [%s]", rule.Metric, strings.Join(metric.Labels, ","))
+	}
+	for _, label := range metric.Labels {
+		if _, ok := rule.Labels[label]; !ok {
+			return fmt.Errorf("metric %s expects the labels [%s]", rule.Metric, strings.Join(metric.Labels, ","))
+		}
+	}
+	if rule.Value == "" && metric.Type != "counter" {
+		return fmt.Errorf("the value field is missing, it is needed for a %s", metric.Type)
+	}
+	return nil
+}
+
+// the value of a field of an event, nested fields are separated by ".", e.g. "data.cause"
+func evapiField(event map[string]interface{}, path string) (string, bool) {
+	var value interface{} = event
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[name]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case nil:
+		return "", false
+	}
+	// objects and arrays as they were sent
+	encoded, err := json.Marshal(value)
+	return string(encoded), err == nil
+}
+
+// the observation of an event, nil if the rule does not match it
+func (rule *evapiRule) observation(event map[string]interface{}) (*pushObservation, error) {
+	for field, expected := range rule.Match {
+		if value, ok := evapiField(event, field); !ok || value != expected {
+			return nil, nil
+		}
+	}
+	observation := &pushObservation{Metric: rule.Metric, Labels: make(map[string]string)}
+	for label, field := range rule.Labels {
+		// missing fields result in an empty label value
+		observation.Labels[label], _ = evapiField(event, field)
+	}
+	if rule.Value != "" {
+		field, ok := evapiField(event, rule.Value)
+		if !ok {
+			return nil, fmt.Errorf("field %s is missing", rule.Value)
+		}
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field %s is not a number", rule.Value)
+		}
+		observation.Value = &value
+	}
+	return observation, nil
+}
+
+// a connection to the evapi endpoint, reconnected until stopped
+type evapiConsumer struct {
+	config  *evapiConfig
+	metrics map[string]*pushMetric
+	log     *log.Entry
+
+	stop chan struct{}
+	done chan struct{}
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+var (
+	// the running consumer, replaced when the configuration changes
+	evapiMu      sync.Mutex
+	evapiRunning *evapiConsumer
+)
+
+// start, replace or stop the consumer according to the current configuration,
+// a nil config stops it
+func configureEvapi(config *evapiConfig) {
+	evapiMu.Lock()
+	defer evapiMu.Unlock()
+	if evapiRunning != nil {
+		if config != nil && reflect.DeepEqual(evapiRunning.config, config) {
+			return
+		}
+		evapiRunning.close()
+		evapiRunning = nil
+	}
+	if config == nil {
+		return
+	}
+	evapiRunning = &evapiConsumer{
+		config:  config,
+		metrics: pushedMetrics("evapi", config.Metrics),
+		log:     log.WithField("evapi", config.Address),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go evapiRunning.run()
+}
+
+func (c *evapiConsumer) run() {
+	defer close(c.done)
+	for {
+		conn, err := net.DialTimeout("tcp", c.config.Address, c.config.ReconnectInterval)
+		if err != nil {
+			warnLimiter.Warnf(c.log, "evapi:connect", "Could not connect to evapi: %s", err)
+		} else {
+			c.mu.Lock()
+			c.conn = conn
+			c.mu.Unlock()
+			select {
+			case <-c.stop:
+				// stopped while connecting
+				conn.Close()
+				return
+			default:
+			}
+			c.log.Info("Connected to evapi")
+			evapiConnected.Set(1)
+			err = c.consume(conn)
+			evapiConnected.Set(0)
+			conn.Close()
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+			warnLimiter.Warnf(c.log, "evapi:connect", "Lost the connection to evapi: %s", err)
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.config.ReconnectInterval):
+		}
+	}
+}
+
+// stop the consumer and wait for it
+func (c *evapiConsumer) close() {
+	close(c.stop)
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+	c.log.Info("Disconnected from evapi")
+}
+
+// read events until the connection fails
+func (c *evapiConsumer) consume(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	for {
+		var message []byte
+		var err error
+		if c.config.Format == evapiNetstring {
+			message, err = readNetstring(reader)
+		} else {
+			message, err = readLine(reader)
+		}
+		if err != nil {
+			return err
+		}
+		if message = bytes.TrimSpace(message); len(message) > 0 {
+			c.handle(message)
+		}
+	}
+}
+
+// read a netstring, e.g. "12:{"event":1},"
+// longer ones than maxEvapiEventSize are a protocol error
+func readNetstring(reader *bufio.Reader) ([]byte, error) {
+	var prefix []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == ':' {
+			break
+		}
+		// the length of the largest allowed netstring plus some whitespace
+		if len(prefix) >= 16 {
+			return nil, fmt.Errorf("invalid netstring length %q", prefix)
+		}
+		prefix = append(prefix, b)
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(string(prefix)))
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid netstring length %q", prefix)
+	}
+	if length > maxEvapiEventSize {
+		return nil, fmt.Errorf("netstring of %d bytes exceeds the limit of %d bytes", length, maxEvapiEventSize)
+	}
+	message := make([]byte, length+1)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	if message[length] != ',' {
+		return nil, fmt.Errorf("netstring without trailing comma")
+	}
+	return message[:length], nil
+}
+
+// read a line, longer ones than maxEvapiEventSize are a protocol error
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxEvapiEventSize+1 {
+			return nil, fmt.Errorf("line exceeds the limit of %d bytes", maxEvapiEventSize)
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// apply the rules to an event
+func (c *evapiConsumer) handle(message []byte) {
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		evapiEvents.WithLabelValues(evapiInvalid).Inc()
+		warnLimiter.Warnf(c.log, "evapi:invalid", "Skipping evapi event, it is not a json object: %s", err)
+		return
+	}
+
+	matched := false
+	for i, rule := range c.config.Rules {
+		observation, err := rule.observation(event)
+		if err == nil && observation != nil {
+			metric := c.metrics[rule.Metric]
+			var labelValues []string
+			if labelValues, err = metric.check(observation); err == nil {
+				err = metric.apply(observation, labelValues)
+			}
+		}
+		if err != nil {
+			warnLimiter.Warnf(c.log, fmt.Sprintf("evapi:rule:%d", i), "Skipping evapi event for rule #%d: %s", i+1, err)
+			continue
+		}
+		if observation != nil {
+			matched = true
+		}
+	}
+	if matched {
+		evapiEvents.WithLabelValues(evapiMatched).Inc()
+	} else {
+		evapiEvents.WithLabelValues(evapiUnmatched).Inc()
+	}
+}
+
+// the metrics of the evapi rules
+func newEvapiCollector(config *collectorConfig) (Collector, error) {
+	if config.settings.evapi == nil {
+		return &pushCollector{}, nil
+	}
+	return newPushedMetricsCollector("evapi consumer", pushedMetrics("evapi", config.settings.evapi.Metrics), config.mappings)
+}
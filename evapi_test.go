@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadNetstring(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(`13:{"event":"a"},0:, 2:{},`))
+	for _, expected := range []string{`{"event":"a"}`, ``, `{}`} {
+		message, err := readNetstring(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message) != expected {
+			t.Errorf("got %q, want %q", message, expected)
+		}
+	}
+	if _, err := readNetstring(reader); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestReadNetstringErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"not a number", "x:{},", "invalid netstring length"},
+		{"negative", "-1:{},", "invalid netstring length"},
+		{"too long", "999999999999999999:{},", "invalid netstring length"},
+		{"exceeds the limit", "1048577:{},", "exceeds the limit"},
+		{"no separator", strings.Repeat("1", 100), "invalid netstring length"},
+		{"without comma", "2:{};", "without trailing comma"},
+		{"truncated", "5:{}", "EOF"},
+	}
+	for _, test := range tests {
+		_, err := readNetstring(bufio.NewReader(strings.NewReader(test.input)))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	// lines longer than the buffer of the reader are assembled
+	long := strings.Repeat("x", 10000)
+	reader := bufio.NewReaderSize(strings.NewReader("{}\n"+long+"\n"), 16)
+	for _, expected := range []string{"{}\n", long + "\n"} {
+		line, err := readLine(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(line) != expected {
+			t.Errorf("got a line of %d bytes, want %d", len(line), len(expected))
+		}
+	}
+
+	reader = bufio.NewReader(strings.NewReader(strings.Repeat("x", maxEvapiEventSize+1) + "\n"))
+	if _, err := readLine(reader); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Errorf("got error %v, want the limit", err)
+	}
+}
+
+func TestEvapiRuleObservation(t *testing.T) {
+	rule := &evapiRule{
+		Match:  map[string]string{"event": "call_end"},
+		Metric: "call_duration_seconds",
+		Labels: map[string]string{"carrier": "data.carrier", "cause": "data.cause"},
+		Value:  "data.duration",
+	}
+	event := map[string]interface{}{
+		"event": "call_end",
+		"data":  map[string]interface{}{"carrier": "a", "duration": "12.5"},
+	}
+	observation, err := rule.observation(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if observation == nil || observation.Labels["carrier"] != "a" || observation.Labels["cause"] != "" || *observation.Value != 12.5 {
+		t.Errorf("unexpected observation %+v", observation)
+	}
+
+	event["event"] = "call_start"
+	if observation, err := rule.observation(event); observation != nil || err != nil {
+		t.Errorf("got %+v %v for an event not matching", observation, err)
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/pascomnet/kamailio_exporter
 
+go 1.16
+
 require (
 	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973
 	github.com/florentchauveau/go-kamailio-binrpc/v2 v2.0.1
@@ -15,4 +17,5 @@ require (
 	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793
 	golang.org/x/sys v0.0.0-20181116152217-5ac8a444bdc5
 	gopkg.in/urfave/cli.v1 v1.20.0
+	gopkg.in/yaml.v3 v3.0.1
 )
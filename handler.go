@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// serves the metrics of a scrape request
+// the collectors can be restricted with collect[]=<name> and exclude[]=<name> query parameters,
+// unless the handler is bound to a fixed set of collectors
+type metricsHandler struct {
+	collector    *StatsCollector
+	constLabels  map[string]string
+	relabelRules []*relabelRule
+	// the collectors of an extra endpoint, empty for the main endpoint
+	collect []string
+	// nil if responses are not cached
+	cache *gatherCache
+}
+
+// a handler for an extra endpoint of the config file
+func newEndpointHandler(collector *StatsCollector, constLabels map[string]string, relabelRules []*relabelRule, endpoint *endpointConfig) (*metricsHandler, error) {
+	// fail early if a collector is disabled
+	if _, err := collector.filtered(endpoint.Collectors, nil); err != nil {
+		return nil, err
+	}
+	handler := &metricsHandler{
+		collector:    collector,
+		constLabels:  constLabels,
+		relabelRules: relabelRules,
+		collect:      endpoint.Collectors,
+	}
+	if endpoint.CacheTTL > 0 {
+		handler.cache = &gatherCache{ttl: endpoint.CacheTTL}
+	}
+	return handler, nil
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var gatherer prometheus.Gatherer
+	if h.cache != nil {
+		gatherer = h.cache.gatherer(func() (prometheus.Gatherer, error) { return h.gatherer(r) })
+	} else {
+		var err error
+		if gatherer, err = h.gatherer(r); err != nil {
+			log.Debugf("Rejecting scrape request %s: %s", r.URL, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// the gatherer for a scrape request
+func (h *metricsHandler) gatherer(r *http.Request) (prometheus.Gatherer, error) {
+	collect := h.collect
+	var exclude []string
+	if len(collect) == 0 {
+		query := r.URL.Query()
+		collect, exclude = query["collect[]"], query["exclude[]"]
+	}
+	collector, err := h.collector.filtered(collect, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	// a registry for this request only, with the collectors it asked for
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return nil, err
+	}
+	// the go and process metrics are part of every response
+	var gatherer prometheus.Gatherer = prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	// with the constant labels added and relabeled according to the config file
+	return &relabelGatherer{newConstLabelGatherer(gatherer, h.constLabels), h.relabelRules}, nil
+}
+
+// keeps the gathered metrics of an endpoint for a while,
+// concurrent requests wait for a single scrape of kamailio
+type gatherCache struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	families []*dto.MetricFamily
+	err      error
+	expires  time.Time
+}
+
+// a gatherer returning the cached metrics, create is only called if they expired
+func (c *gatherCache) gatherer(create func() (prometheus.Gatherer, error)) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if time.Now().Before(c.expires) {
+			return c.families, c.err
+		}
+		gatherer, err := create()
+		if err != nil {
+			return nil, err
+		}
+		c.families, c.err = gatherer.Gather()
+		c.expires = time.Now().Add(c.ttl)
+		return c.families, c.err
+	})
+}
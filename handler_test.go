@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// a collector of the default configuration with the given flags
+func newTestStatsCollector(t *testing.T, args ...string) *StatsCollector {
+	t.Helper()
+	settings, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector, err := NewStatsCollector(newTestContext(t, args...), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collector
+}
+
+func collectorNames(c *StatsCollector) []string {
+	names := []string{}
+	for _, collector := range c.collectors {
+		names = append(names, collector.name)
+	}
+	return names
+}
+
+func TestFilteredCollectors(t *testing.T) {
+	collector := newTestStatsCollector(t, "--catchAll", catchAllNames, "--no-collector.tcp", "--no-collector.htable", "--no-collector.shv")
+	all := collectorNames(collector)
+	tests := []struct {
+		collect    []string
+		exclude    []string
+		collectors []string
+		catchAll   string
+	}{
+		{nil, nil, all, catchAllNames},
+		// in the order of the registry, and the remaining stats are left out
+		{[]string{"sl", "core"}, nil, []string{"core", "sl"}, catchAllOff},
+		{[]string{"sl", "core"}, []string{"core"}, []string{"sl"}, catchAllOff},
+		{nil, []string{"core", "sl", "shmem", "tmx", "dialog", "registrar", "usrloc"}, []string{"scripted", "push", "evapi", "statsd"}, catchAllNames},
+	}
+	for _, test := range tests {
+		filtered, err := collector.filtered(test.collect, test.exclude)
+		if err != nil {
+			t.Errorf("collect %v exclude %v: %s", test.collect, test.exclude, err)
+			continue
+		}
+		if names := collectorNames(filtered); !reflect.DeepEqual(names, test.collectors) || filtered.catchAll != test.catchAll {
+			t.Errorf("collect %v exclude %v: got %v with catch-all %s, want %v with %s", test.collect, test.exclude, names, filtered.catchAll, test.collectors, test.catchAll)
+		}
+	}
+	if !reflect.DeepEqual(collectorNames(collector), all) {
+		t.Errorf("filtering changed the collector")
+	}
+}
+
+func TestMetricsHandlerRejectsInvalidFilters(t *testing.T) {
+	handler := &metricsHandler{collector: newTestStatsCollector(t, "--no-collector.tcp")}
+	for _, query := range []string{"collect[]=unknown", "collect[]=tcp", "exclude[]=tcp"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics?"+query, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGatherCache(t *testing.T) {
+	cache := &gatherCache{ttl: time.Hour}
+	created := 0
+	create := func() (prometheus.Gatherer, error) {
+		created++
+		return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return []*dto.MetricFamily{{Name: proto.String("kamailio_up")}}, nil
+		}), nil
+	}
+	for i := 0; i < 3; i++ {
+		families, err := cache.gatherer(create).Gather()
+		if err != nil || len(families) != 1 {
+			t.Fatalf("got %v %v, want the cached metrics", families, err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("created %d gatherers within the ttl, want 1", created)
+	}
+	cache.expires = time.Now()
+	cache.gatherer(create).Gather()
+	if created != 2 {
+		t.Errorf("the metrics were not gathered again after the ttl")
+	}
+
+	// requests which can't be served are not cached
+	failing := &gatherCache{ttl: time.Hour}
+	for i := 0; i < 2; i++ {
+		if _, err := failing.gatherer(func() (prometheus.Gatherer, error) { return nil, errors.New("invalid") }).Gather(); err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+	if _, err := failing.gatherer(create).Gather(); err != nil {
+		t.Errorf("a failed request was cached: %s", err)
+	}
+}
+
+func TestNewEndpointHandler(t *testing.T) {
+	collector := newTestStatsCollector(t, "--no-collector.tcp")
+	handler, err := newEndpointHandler(collector, nil, nil, &endpointConfig{Path: "/sip", Collectors: []string{"sl", "tmx"}, CacheTTL: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handler.cache == nil || handler.cache.ttl != time.Second {
+		t.Errorf("got cache %v, want a ttl of 1s", handler.cache)
+	}
+	// the collectors of the endpoint can't be changed by the request
+	if _, err := handler.gatherer(httptest.NewRequest(http.MethodGet, "/sip?collect[]=unknown", nil)); err != nil {
+		t.Errorf("the endpoint used the collectors of the request: %s", err)
+	}
+	for _, collectors := range [][]string{{"tcp"}, {"unknown"}} {
+		if _, err := newEndpointHandler(collector, nil, nil, &endpointConfig{Path: "/sip", Collectors: collectors}); err == nil {
+			t.Errorf("%v: expected an error", collectors)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scripted stats following the histogram convention, e.g. for a histogram "pdd_seconds":
+//
+//	pdd_seconds_bucket_le_0_5   observations <= 0.5 (cumulative, like prometheus buckets)
+//	pdd_seconds_bucket_le_inf   all observations, optional if pdd_seconds_count exists
+//	pdd_seconds_sum             sum of all observations
+//	pdd_seconds_count           number of observations
+var scriptedBucketRegexp = regexp.MustCompile(`^(.+)_bucket_le_(inf|\d+(?:_\d+)?)$`)
+
+// a histogram assembled from scripted stats
+type scriptedHistogram struct {
+	// the group of the first bucket
+	group       *scriptedGroupConfig
+	name        string
+	labelNames  []string
+	labelValues []string
+	// stat keys by upper bound, including +Inf
+	buckets  map[float64]string
+	sumKey   string
+	countKey string
+}
+
+// the upper bound of a bucket, "0_5" => 0.5, "inf" => +Inf
+func parseBucketBound(bound string) (float64, error) {
+	if bound == "inf" {
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(strings.Replace(bound, "_", ".", 1), 64)
+}
+
+// identifies a histogram, or a series of one
+func histogramKey(name string, labelValues []string) string {
+	return name + "{" + strings.Join(labelValues, "\xff") + "}"
+}
+
+// the first stat key of a histogram, in sort order
+func (h *scriptedHistogram) firstKey() string {
+	var keys []string
+	for _, key := range h.buckets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys[0]
+}
+
+// split the scripted stats into histograms and the remaining stats
+func collectScriptedHistograms(stats []*scriptedStat) ([]*scriptedHistogram, []*scriptedStat) {
+	histograms := make(map[string]*scriptedHistogram)
+	var order []string
+	var others []*scriptedStat
+	for _, stat := range stats {
+		match := scriptedBucketRegexp.FindStringSubmatch(stat.name)
+		if match == nil {
+			others = append(others, stat)
+			continue
+		}
+		bound, err := parseBucketBound(match[2])
+		if err != nil {
+			others = append(others, stat)
+			continue
+		}
+		key := histogramKey(match[1], stat.labelValues)
+		histogram, ok := histograms[key]
+		if !ok {
+			histogram = &scriptedHistogram{
+				group:       stat.group,
+				name:        match[1],
+				labelNames:  stat.labelNames,
+				labelValues: stat.labelValues,
+				buckets:     make(map[float64]string),
+			}
+			histograms[key] = histogram
+			order = append(order, key)
+		}
+		histogram.buckets[bound] = stat.key
+	}
+
+	// the sum and count of a histogram are only recognized if it has buckets
+	var remaining []*scriptedStat
+	for _, stat := range others {
+		if base := strings.TrimSuffix(stat.name, "_sum"); base != stat.name {
+			if histogram, ok := histograms[histogramKey(base, stat.labelValues)]; ok {
+				histogram.sumKey = stat.key
+				continue
+			}
+		}
+		if base := strings.TrimSuffix(stat.name, "_count"); base != stat.name {
+			if histogram, ok := histograms[histogramKey(base, stat.labelValues)]; ok {
+				histogram.countKey = stat.key
+				continue
+			}
+		}
+		remaining = append(remaining, stat)
+	}
+
+	result := make([]*scriptedHistogram, 0, len(order))
+	for _, key := range order {
+		result = append(result, histograms[key])
+	}
+	return result, remaining
+}
+
+// produce a histogram metric, an inconsistent set of stats results in an error
+func produceScriptedHistogram(s *scrape, histogram *scriptedHistogram, data map[string]string, desc *prometheus.Desc, metricChannel chan<- prometheus.Metric) error {
+	value := func(key string) (float64, error) {
+		s.exported[key] = true
+		v, err := strconv.ParseFloat(data[key], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value of %s: %s", key, err)
+		}
+		return v, nil
+	}
+
+	if histogram.sumKey == "" {
+		return fmt.Errorf("%s_sum is missing", histogram.name)
+	}
+	sum, err := value(histogram.sumKey)
+	if err != nil {
+		return err
+	}
+
+	var bounds []float64
+	for bound := range histogram.buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	buckets := make(map[float64]uint64)
+	previous := 0.0
+	for _, bound := range bounds {
+		cumulative, err := value(histogram.buckets[bound])
+		if err != nil {
+			return err
+		}
+		if cumulative < previous {
+			return fmt.Errorf("buckets are not cumulative, %s is lower than a bucket with a lower bound", histogram.buckets[bound])
+		}
+		previous = cumulative
+		if !math.IsInf(bound, 1) {
+			buckets[bound] = uint64(cumulative)
+		}
+	}
+
+	// the count and the +Inf bucket are the same, one of them is enough
+	count := previous
+	inf, hasInf := histogram.buckets[math.Inf(1)]
+	if histogram.countKey != "" {
+		if count, err = value(histogram.countKey); err != nil {
+			return err
+		}
+		if hasInf && count != previous {
+			return fmt.Errorf("%s differs from %s", histogram.countKey, inf)
+		}
+		if count < previous {
+			return fmt.Errorf("%s is lower than the buckets", histogram.countKey)
+		}
+	} else if !hasInf {
+		return fmt.Errorf("%s_count and the +Inf bucket are missing", histogram.name)
+	}
+
+	return s.sendHistogram(metricChannel, desc, uint64(count), sum, buckets, histogram.labelValues...)
+}
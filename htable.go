@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// a htable whose entries are exported, declared in the config file
+// See https://www.kamailio.org/docs/modules/5.2.x/modules/htable.html
+type htableConfig struct {
+	Table string `yaml:"table"`
+	// matches the keys to export, its named groups become the labels, "^(?P<key>.*)$" if omitted
+	KeyRegex string `yaml:"key_regex"`
+	// the metric name, "kamailio_htable_<table>" if omitted
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	// counter or gauge, gauge if omitted
+	Type string `yaml:"type"`
+	// series of this entry per scrape, 0 means unlimited
+	SeriesLimit int `yaml:"series_limit"`
+}
+
+// a validated htable declaration, ready to be used
+type htableMetric struct {
+	table    string
+	name     string
+	keyRegex *regexp.Regexp
+	// indexes of the named groups of keyRegex, in the order of the label names
+	labelGroups []int
+	seriesLimit int
+	valueType   prometheus.ValueType
+	description *prometheus.Desc
+}
+
+const defaultHtableKeyRegex = `^(?P<key>.*)$`
+
+func newHtableMetric(config *htableConfig) (*htableMetric, error) {
+	if config.Table == "" {
+		return nil, fmt.Errorf("table is missing")
+	}
+	name := config.Name
+	if name == "" {
+		name = "kamailio_htable_" + sanitizeMetricName(config.Table)
+	}
+	if !metricNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+	valueType := prometheus.GaugeValue
+	switch config.Type {
+	case "", "gauge":
+	case "counter":
+		valueType = prometheus.CounterValue
+	default:
+		return nil, fmt.Errorf("unknown type %q, use one of counter or gauge", config.Type)
+	}
+	if config.SeriesLimit < 0 {
+		return nil, fmt.Errorf("series_limit must not be negative")
+	}
+
+	expression := config.KeyRegex
+	if expression == "" {
+		expression = defaultHtableKeyRegex
+	}
+	keyRegex, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key_regex: %s", err)
+	}
+	// only the named groups are labels, the others just help matching
+	var labelNames []string
+	var labelGroups []int
+	for i, groupName := range keyRegex.SubexpNames() {
+		if groupName == "" {
+			continue
+		}
+		if !labelNameRegexp.MatchString(groupName) || strings.HasPrefix(groupName, "__") {
+			return nil, fmt.Errorf("invalid label name %q in key_regex", groupName)
+		}
+		labelNames = append(labelNames, groupName)
+		labelGroups = append(labelGroups, i)
+	}
+
+	help := config.Help
+	if help == "" {
+		help = "Entries of htable " + config.Table
+	}
+	return &htableMetric{
+		table:       config.Table,
+		name:        name,
+		keyRegex:    keyRegex,
+		labelGroups: labelGroups,
+		seriesLimit: config.SeriesLimit,
+		valueType:   valueType,
+		description: prometheus.NewDesc(name, help, labelNames, nil),
+	}, nil
+}
+
+// a collector producing the integer entries of the htables of the config file
+type htableCollector struct {
+	metrics []*htableMetric
+}
+
+func newHtableCollector(config *collectorConfig) (Collector, error) {
+	for _, metric := range config.settings.htables {
+		for _, mapping := range config.mappings {
+			if mapping.name == metric.name {
+				return nil, fmt.Errorf("metric %s of htable %s collides with a built-in metric", metric.name, metric.table)
+			}
+		}
+	}
+	return &htableCollector{metrics: config.settings.htables}, nil
+}
+
+func (c *htableCollector) Update(s *scrape, metricChannel chan<- prometheus.Metric) error {
+	// every table is dumped once, no matter how many metrics it feeds
+	dumps := make(map[string][]htableEntry)
+	for _, metric := range c.metrics {
+		entries, ok := dumps[metric.table]
+		if !ok {
+			var err error
+			if entries, err = dumpHtable(s.rpc, metric.table); err != nil {
+				warnLimiter.Errorf(s.log, "htable:"+metric.table, "Could not dump htable %s: %s", metric.table, err)
+			}
+			dumps[metric.table] = entries
+		}
+		if producer, ok := s.names[metric.name]; ok {
+			warnLimiter.Warnf(s.log, "htable:"+metric.name, "Skipping htable %s, metric %s is already produced by %s", metric.table, metric.name, producer)
+			continue
+		}
+		s.names[metric.name] = "htable " + metric.table
+		produceHtableMetric(s, metric, entries, metricChannel)
+	}
+	return nil
+}
+
+// an item of a htable
+type htableEntry struct {
+	key string
+	// int or string
+	value interface{}
+}
+
+// perform a "htable.dump" rpc call, the entries are sorted by key
+func dumpHtable(rpc *rpcSession, table string) ([]htableEntry, error) {
+	values, err := rpc.callValues("htable.dump", table)
+	if err != nil {
+		return nil, err
+	}
+
+	// a struct per hash slot: {entry, size, slot: [{name, value, type}, ...]}
+	var entries []htableEntry
+	for _, value := range values {
+		slot, ok := value.([]rpcMember)
+		if !ok {
+			return nil, fmt.Errorf("unexpected htable.dump response")
+		}
+		items, _ := rpcMemberValue(slot, "slot")
+		itemList, ok := items.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected htable.dump response, slot is missing")
+		}
+		for _, item := range itemList {
+			members, ok := item.([]rpcMember)
+			if !ok {
+				return nil, fmt.Errorf("unexpected htable.dump response, invalid item")
+			}
+			name, _ := rpcMemberValue(members, "name")
+			key, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected htable.dump response, item without name")
+			}
+			itemValue, _ := rpcMemberValue(members, "value")
+			entries = append(entries, htableEntry{key: key, value: itemValue})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// produce a series for every integer entry matching the key regex
+func produceHtableMetric(s *scrape, metric *htableMetric, entries []htableEntry, metricChannel chan<- prometheus.Metric) {
+	series := 0
+	// the entry producing a series, by label values
+	seen := make(map[string]string)
+	for _, entry := range entries {
+		match := metric.keyRegex.FindStringSubmatch(entry.key)
+		if match == nil {
+			continue
+		}
+		value, ok := entry.value.(int)
+		if !ok {
+			s.log.Debugf("Skipping htable entry %s[%s], its value is not an integer", metric.table, entry.key)
+			continue
+		}
+		labelValues := make([]string, len(metric.labelGroups))
+		for i, group := range metric.labelGroups {
+			labelValues[i] = match[group]
+		}
+		seriesKey := strings.Join(labelValues, "\xff")
+		if other, ok := seen[seriesKey]; ok {
+			warnLimiter.Warnf(s.log, "htable:"+metric.table+":"+entry.key,
+				"Skipping htable entry %s[%s], it has the same labels as %s", metric.table, entry.key, other)
+			continue
+		}
+		seen[seriesKey] = entry.key
+
+		if metric.seriesLimit > 0 && series >= metric.seriesLimit {
+			s.guard.limit(metric.description, metric.valueType, float64(value), labelValues)
+			continue
+		}
+		series++
+		if err := s.sendMetric(metricChannel, metric.description, metric.valueType, float64(value), labelValues...); err != nil {
+			warnLimiter.Warnf(s.log, "htable:"+metric.table+":"+entry.key, "Skipping htable entry %s[%s]: %s", metric.table, entry.key, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewHtableMetric(t *testing.T) {
+	metric, err := newHtableMetric(&htableConfig{Table: "gw-calls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric.name != "kamailio_htable_gw_calls" || metric.valueType != prometheus.GaugeValue || !reflect.DeepEqual(metric.keyRegex.SubexpNames(), []string{"", "key"}) {
+		t.Errorf("got %s %v %v, want the defaults", metric.name, metric.valueType, metric.keyRegex.SubexpNames())
+	}
+
+	tests := []struct {
+		name   string
+		config htableConfig
+	}{
+		{"table missing", htableConfig{}},
+		{"invalid name", htableConfig{Table: "calls", Name: "kamailio-calls"}},
+		{"unknown type", htableConfig{Table: "calls", Type: "histogram"}},
+		{"negative limit", htableConfig{Table: "calls", SeriesLimit: -1}},
+		{"invalid regex", htableConfig{Table: "calls", KeyRegex: "(?P<gw>.*"}},
+		{"reserved label", htableConfig{Table: "calls", KeyRegex: "(?P<__gw>.*)"}},
+	}
+	for _, test := range tests {
+		if _, err := newHtableMetric(&test.config); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestProduceHtableMetric(t *testing.T) {
+	entries := []htableEntry{
+		{"gw1::calls", 3},
+		{"gw1::limit", 10},
+		{"gw2::calls", 5},
+		{"gw3::calls", "many"},
+		{"gw4::calls", 7},
+		{"gw5::calls", 9},
+	}
+	tests := []struct {
+		name   string
+		config htableConfig
+		action string
+		series map[string]float64
+	}{
+		{
+			// the unnamed group only helps matching
+			"key regex", htableConfig{Table: "gw", KeyRegex: `^(?P<gw>[^:]+)::(calls)$`}, seriesLimitDrop,
+			map[string]float64{"gw1": 3, "gw2": 5, "gw4": 7, "gw5": 9},
+		},
+		{
+			"entries with the same labels", htableConfig{Table: "gw", KeyRegex: `^(?P<gw>[^:]+)::`}, seriesLimitDrop,
+			map[string]float64{"gw1": 3, "gw2": 5, "gw4": 7, "gw5": 9},
+		},
+		{
+			"series limit dropping", htableConfig{Table: "gw", KeyRegex: `^(?P<gw>[^:]+)::calls$`, SeriesLimit: 2}, seriesLimitDrop,
+			map[string]float64{"gw1": 3, "gw2": 5},
+		},
+		{
+			"series limit folding", htableConfig{Table: "gw", KeyRegex: `^(?P<gw>[^:]+)::calls$`, SeriesLimit: 2}, seriesLimitFold,
+			map[string]float64{"gw1": 3, "gw2": 5, "other": 16},
+		},
+	}
+	for _, test := range tests {
+		metric, err := newHtableMetric(&test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limits, err := newSeriesLimits(0, 0, nil, test.action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		series := collectSeries(t, limits, func(s *scrape, metricChannel chan<- prometheus.Metric) {
+			produceHtableMetric(s, metric, entries, metricChannel)
+		})
+		if !reflect.DeepEqual(series, test.series) {
+			t.Errorf("%s: got %v, want %v", test.name, series, test.series)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Version of the known stats registry below. Bump it whenever stats are added or corrected,
+// it is logged at startup to make it easy to tell which types an exporter assumes.
+// The registry covers the stats of Kamailio 5.2 up to 5.8.
+const knownStatsVersion = "2"
+
+// semantic of a well-known kamailio stat
+type knownStat struct {
+	valueType prometheus.ValueType
+	// base unit of the value, e.g. "bytes" or "seconds", empty if it's a plain count
+	unit string
+	help string
+}
+
+func counterStat(help string) knownStat {
+	return knownStat{valueType: prometheus.CounterValue, help: help}
+}
+
+func gaugeStat(unit string, help string) knownStat {
+	return knownStat{valueType: prometheus.GaugeValue, unit: unit, help: help}
+}
+
+// stats reported by "stats.fetch all" of kamailio core and commonly used modules
+var knownStats = map[string]knownStat{
+	// core
+	"core.bad_URIs_rcvd":             counterStat("Messages with bad URIs received"),
+	"core.bad_msg_hdr":               counterStat("Messages with bad message header received"),
+	"core.drop_replies":              counterStat("Dropped replies"),
+	"core.drop_requests":             counterStat("Dropped requests"),
+	"core.err_replies":               counterStat("Replies with errors"),
+	"core.err_requests":              counterStat("Requests with errors"),
+	"core.fwd_replies":               counterStat("Forwarded replies"),
+	"core.fwd_requests":              counterStat("Forwarded requests"),
+	"core.rcv_replies":               counterStat("Received replies"),
+	"core.rcv_requests":              counterStat("Received requests"),
+	"core.unsupported_methods":       counterStat("Received requests with unsupported methods"),
+	"dns.failed_dns_request":         counterStat("Failed DNS requests"),
+	"dns.slow_dns_request":           counterStat("Slow DNS requests"),
+	"shmem.fragments":                gaugeStat("", "Shared memory fragments"),
+	"shmem.free_size":                gaugeStat("bytes", "Free shared memory"),
+	"shmem.max_used_size":            gaugeStat("bytes", "Maximum used shared memory"),
+	"shmem.real_used_size":           gaugeStat("bytes", "Used shared memory including overhead"),
+	"shmem.total_size":               gaugeStat("bytes", "Total shared memory"),
+	"shmem.used_size":                gaugeStat("bytes", "Used shared memory"),
+	"tcp.con_reset":                  counterStat("TCP connections reset by the peer"),
+	"tcp.con_timeout":                counterStat("TCP connections closed because of a timeout"),
+	"tcp.connect_failed":             counterStat("Failed outgoing TCP connections"),
+	"tcp.connect_success":            counterStat("Successful outgoing TCP connections"),
+	"tcp.established":                counterStat("Established TCP connections"),
+	"tcp.local_reject":               counterStat("Incoming TCP connections rejected by kamailio"),
+	"tcp.passive_open":               counterStat("Accepted incoming TCP connections"),
+	"tcp.send_timeout":               counterStat("TCP sends which timed out"),
+	"tcp.sendq_full":                 counterStat("TCP sends which failed because of a full send queue"),
+	"tcp.current_opened_connections": gaugeStat("", "Currently opened TCP connections"),
+	"tcp.current_write_queue_size":   gaugeStat("bytes", "Current TCP write queue size"),
+
+	// sl
+	"sl.failures":         counterStat("Stateless replies which could not be sent"),
+	"sl.received_ACKs":    counterStat("ACKs to stateless replies"),
+	"sl.sent_err_replies": counterStat("Stateless error replies sent"),
+	"sl.sent_replies":     counterStat("Stateless replies sent"),
+
+	// tmx
+	"tmx.UAC_transactions":    counterStat("Transactions created by kamailio"),
+	"tmx.UAS_transactions":    counterStat("Transactions created by received requests"),
+	"tmx.active_transactions": gaugeStat("", "Ongoing transactions"),
+	"tmx.inuse_transactions":  gaugeStat("", "Transactions in memory, including the ones in wait state"),
+	"tmx.rpl_absorbed":        counterStat("Absorbed replies"),
+	"tmx.rpl_generated":       counterStat("Locally generated replies"),
+	"tmx.rpl_received":        counterStat("Received replies"),
+	"tmx.rpl_relayed":         counterStat("Relayed replies"),
+	"tmx.rpl_sent":            counterStat("Sent replies"),
+
+	// dialog
+	"dialog.active_dialogs":    gaugeStat("", "Confirmed dialogs"),
+	"dialog.early_dialogs":     gaugeStat("", "Early dialogs"),
+	"dialog.expired_dialogs":   counterStat("Dialogs which expired"),
+	"dialog.failed_dialogs":    counterStat("Dialogs which failed"),
+	"dialog.processed_dialogs": counterStat("Processed dialogs"),
+
+	// registrar
+	"registrar.accepted_regs":         counterStat("Accepted registrations"),
+	"registrar.rejected_regs":         counterStat("Rejected registrations"),
+	"registrar.default_expire":        gaugeStat("seconds", "Default expires value"),
+	"registrar.default_expires_range": gaugeStat("", "Default expires range in percent"),
+	"registrar.expires_range":         gaugeStat("", "Expires range in percent"),
+	"registrar.max_contacts":          gaugeStat("", "Maximum contacts per address of record"),
+	"registrar.max_expires":           gaugeStat("seconds", "Maximum expires value"),
+
+	// usrloc
+	"usrloc.registered_users": gaugeStat("", "Registered users in all location tables"),
+
+	// websocket
+	"websocket.ws_current_connections":             gaugeStat("", "Currently opened websocket connections"),
+	"websocket.ws_max_concurrent_connections":      gaugeStat("", "Maximum concurrent websocket connections"),
+	"websocket.ws_sip_current_connections":         gaugeStat("", "Currently opened websocket connections using SIP"),
+	"websocket.ws_sip_max_concurrent_connections":  gaugeStat("", "Maximum concurrent websocket connections using SIP"),
+	"websocket.ws_msrp_current_connections":        gaugeStat("", "Currently opened websocket connections using MSRP"),
+	"websocket.ws_msrp_max_concurrent_connections": gaugeStat("", "Maximum concurrent websocket connections using MSRP"),
+	"websocket.ws_failed_connections":              counterStat("Failed websocket connections"),
+	"websocket.ws_failed_handshakes":               counterStat("Failed websocket handshakes"),
+	"websocket.ws_local_closed_connections":        counterStat("Websocket connections closed by kamailio"),
+	"websocket.ws_remote_closed_connections":       counterStat("Websocket connections closed by the peer"),
+	"websocket.ws_received_frames":                 counterStat("Received websocket frames"),
+	"websocket.ws_successful_handshakes":           counterStat("Successful websocket handshakes"),
+	"websocket.ws_transmitted_frames":              counterStat("Transmitted websocket frames"),
+
+	// misc modules
+	"mysql.driver_errors":      counterStat("MySQL driver errors"),
+	"siptrace.traced_replies":  counterStat("Traced replies"),
+	"siptrace.traced_requests": counterStat("Traced requests"),
+}
+
+// stats with dynamic names, matched by a glob pattern
+// they are only consulted if a stat is not found in knownStats
+var knownStatPatterns = []struct {
+	pattern string
+	stat    knownStat
+}{
+	{"core.rcv_requests_*", counterStat("Received requests by method")},
+	{"core.rcv_replies_*", counterStat("Received replies by code")},
+	{"sl.*_replies", counterStat("Stateless replies by code")},
+	{"tmx.*_transactions", counterStat("Completed transactions by code")},
+	{"usrloc.*-users", gaugeStat("", "Registered users in a location table")},
+	{"usrloc.*-contacts", gaugeStat("", "Registered contacts in a location table")},
+	{"usrloc.*-expires", counterStat("Expired contacts in a location table")},
+	{"websocket.ws_sip_*_frames", counterStat("Websocket frames using SIP")},
+	{"websocket.ws_msrp_*_frames", counterStat("Websocket frames using MSRP")},
+	{"websocket.ws_sip_*_connections", counterStat("Websocket connections using SIP")},
+	{"websocket.ws_msrp_*_connections", counterStat("Websocket connections using MSRP")},
+	{"websocket.ws_sip_*_handshakes", counterStat("Websocket handshakes using SIP")},
+	{"websocket.ws_msrp_*_handshakes", counterStat("Websocket handshakes using MSRP")},
+}
+
+// look up the semantic of a kamailio stat
+func lookupKnownStat(key string) (knownStat, bool) {
+	if stat, ok := knownStats[key]; ok {
+		return stat, true
+	}
+	for _, known := range knownStatPatterns {
+		if ok, _ := path.Match(known.pattern, key); ok {
+			return known.stat, true
+		}
+	}
+	return knownStat{}, false
+}
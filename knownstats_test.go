@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the stats of testdata/stats_fetch_all.txt, in the format of "kamcmd stats.fetch all".
+// The keys are the ones of kamailio 5.x with the modules of the built-in mappings loaded.
+// The values are not recorded from a live instance, they are made up to be consistent with
+// each other (the per-method and per-class counters add up, usrloc users match registered_users),
+// so replace the file by a recorded dump when one is at hand, noting the kamailio version.
+func readStatsFixture(t *testing.T) map[string]string {
+	t.Helper()
+	file, err := os.Open("testdata/stats_fetch_all.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	stats := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "{" || line == "}" {
+			continue
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			t.Fatalf("unexpected line %q in the fixture", line)
+		}
+		stats[line[:i]] = line[i+2:]
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestKnownStatsCoverFixture(t *testing.T) {
+	for key := range readStatsFixture(t) {
+		if _, ok := lookupKnownStat(key); !ok {
+			t.Errorf("%s is not a known stat", key)
+		}
+	}
+}
+
+func TestLookupKnownStat(t *testing.T) {
+	tests := []struct {
+		key       string
+		valueType prometheus.ValueType
+		unit      string
+	}{
+		{"core.rcv_requests", prometheus.CounterValue, ""},
+		{"core.rcv_requests_invite", prometheus.CounterValue, ""},
+		{"core.rcv_replies_1xx_bye", prometheus.CounterValue, ""},
+		{"shmem.free_size", prometheus.GaugeValue, "bytes"},
+		{"shmem.fragments", prometheus.GaugeValue, ""},
+		{"sl.200_replies", prometheus.CounterValue, ""},
+		{"tmx.active_transactions", prometheus.GaugeValue, ""},
+		{"tmx.2xx_transactions", prometheus.CounterValue, ""},
+		{"dialog.active_dialogs", prometheus.GaugeValue, ""},
+		{"dialog.processed_dialogs", prometheus.CounterValue, ""},
+		{"registrar.max_expires", prometheus.GaugeValue, "seconds"},
+		{"usrloc.location-users", prometheus.GaugeValue, ""},
+		{"usrloc.location-expires", prometheus.CounterValue, ""},
+		{"websocket.ws_sip_received_frames", prometheus.CounterValue, ""},
+	}
+	for _, test := range tests {
+		known, ok := lookupKnownStat(test.key)
+		if !ok {
+			t.Errorf("%s: not found", test.key)
+			continue
+		}
+		if known.valueType != test.valueType || known.unit != test.unit {
+			t.Errorf("%s: got type %v unit %q, want type %v unit %q", test.key, known.valueType, known.unit, test.valueType, test.unit)
+		}
+	}
+	if _, ok := lookupKnownStat("script.calls"); ok {
+		t.Errorf("script.calls: found an unknown stat")
+	}
+}
+
+func TestMappingValueType(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    metricMappingConfig
+		valueType prometheus.ValueType
+		err       bool
+	}{
+		{"declared", metricMappingConfig{Type: "gauge", Stats: []statMappingConfig{{Key: "core.rcv_requests"}}}, prometheus.GaugeValue, false},
+		{"invalid", metricMappingConfig{Type: "summary"}, 0, true},
+		{"known counters", metricMappingConfig{Stats: []statMappingConfig{{Key: "sl.failures"}, {Key: "sl.sent_replies"}}}, prometheus.CounterValue, false},
+		{"known gauges", metricMappingConfig{Stats: []statMappingConfig{{Key: "shmem.free_size"}, {Key: "shmem.used_size"}}}, prometheus.GaugeValue, false},
+		{"known pattern", metricMappingConfig{Stats: []statMappingConfig{{Pattern: "core.rcv_requests_*"}}}, prometheus.CounterValue, false},
+		{"mixed", metricMappingConfig{Stats: []statMappingConfig{{Key: "dialog.active_dialogs"}, {Key: "dialog.failed_dialogs"}}}, 0, true},
+		{"unknown", metricMappingConfig{Stats: []statMappingConfig{{Key: "script.calls"}}}, 0, true},
+		{"regex", metricMappingConfig{Stats: []statMappingConfig{{Regex: `^sl\.(?P<code>\d+)_replies$`}}}, 0, true},
+	}
+	for _, test := range tests {
+		valueType, err := mappingValueType(test.config)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if valueType != test.valueType {
+			t.Errorf("%s: got type %v, want %v", test.name, valueType, test.valueType)
+		}
+	}
+}
+
+// the fixture holds the stats of the mappings with the same type as the known stats
+func TestMappingValueTypeOfFixture(t *testing.T) {
+	for key := range readStatsFixture(t) {
+		known, _ := lookupKnownStat(key)
+		valueType, err := mappingValueType(metricMappingConfig{Stats: []statMappingConfig{{Key: key}}})
+		if err != nil {
+			t.Errorf("%s: %s", key, err)
+			continue
+		}
+		if valueType != known.valueType {
+			t.Errorf("%s: got type %v, want %v", key, valueType, known.valueType)
+		}
+	}
+}
+
+func TestInferStat(t *testing.T) {
+	// known stats keep their semantic
+	for key := range readStatsFixture(t) {
+		known, _ := lookupKnownStat(key)
+		if inferred := inferStat(key); inferred != known {
+			t.Errorf("%s: inferred %+v, want %+v", key, inferred, known)
+		}
+	}
+	tests := []struct {
+		key       string
+		valueType prometheus.ValueType
+	}{
+		{"app.calls_total", prometheus.CounterValue},
+		{"app.sent_invites", prometheus.CounterValue},
+		{"app.auth_failed", prometheus.CounterValue},
+		{"nat_traversal.registered_endpoints", prometheus.GaugeValue},
+		{"app.Active_Calls", prometheus.GaugeValue},
+	}
+	for _, test := range tests {
+		if inferred := inferStat(test.key); inferred.valueType != test.valueType {
+			t.Errorf("%s: inferred type %v, want %v", test.key, inferred.valueType, test.valueType)
+		}
+	}
+}
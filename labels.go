@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// environment variables with this prefix define constant labels,
+// e.g. KAMAILIO_EXPORTER_LABEL_SITE=fra results in site="fra"
+const constLabelEnvPrefix = "KAMAILIO_EXPORTER_LABEL_"
+
+// Parse the constant labels of the --label flags and the environment.
+// A --label flag wins over an environment variable of the same name.
+func parseConstLabels(flags []string, environ []string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, env := range environ {
+		if !strings.HasPrefix(env, constLabelEnvPrefix) {
+			continue
+		}
+		pair := strings.SplitN(strings.TrimPrefix(env, constLabelEnvPrefix), "=", 2)
+		name := strings.ToLower(pair[0])
+		if err := checkConstLabel(name, pair[1]); err != nil {
+			return nil, fmt.Errorf("environment variable %s%s: %s", constLabelEnvPrefix, pair[0], err)
+		}
+		labels[name] = pair[1]
+	}
+
+	fromFlags := make(map[string]bool)
+	for _, flag := range flags {
+		pair := strings.SplitN(flag, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("label %q: expected key=value", flag)
+		}
+		if err := checkConstLabel(pair[0], pair[1]); err != nil {
+			return nil, fmt.Errorf("label %q: %s", flag, err)
+		}
+		if fromFlags[pair[0]] {
+			return nil, fmt.Errorf("label %q: %s is defined more than once", flag, pair[0])
+		}
+		fromFlags[pair[0]] = true
+		labels[pair[0]] = pair[1]
+	}
+	return labels, nil
+}
+
+func checkConstLabel(name string, value string) error {
+	if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if value == "" {
+		return fmt.Errorf("the value of %s is empty", name)
+	}
+	return nil
+}
+
+// make sure no constant label overwrites a label of an exported metric
+func checkConstLabelClashes(labels map[string]string, usedLabelNames map[string]bool) error {
+	for name := range labels {
+		if usedLabelNames[name] {
+			return fmt.Errorf("label %s clashes with a label of the exported metrics", name)
+		}
+	}
+	return nil
+}
+
+// a prometheus.Gatherer adding constant labels to every metric of another gatherer
+type constLabelGatherer struct {
+	gatherer prometheus.Gatherer
+	labels   []*dto.LabelPair
+}
+
+func newConstLabelGatherer(gatherer prometheus.Gatherer, labels map[string]string) prometheus.Gatherer {
+	if len(labels) == 0 {
+		return gatherer
+	}
+	return &constLabelGatherer{gatherer, labelPairs(labels)}
+}
+
+// part of the prometheus.Gatherer interface
+func (g *constLabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			has := make(map[string]bool, len(metric.Label))
+			for _, pair := range metric.Label {
+				has[pair.GetName()] = true
+			}
+			for _, pair := range g.labels {
+				// the label of the metric itself wins, e.g. for metrics registered by libraries
+				if has[pair.GetName()] {
+					warnLimiter.Warnf(log.WithField("metric", family.GetName()), "constlabel:"+family.GetName(),
+						"Not adding constant label %s, the metric already has it", pair.GetName())
+					continue
+				}
+				metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(pair.GetName()), Value: proto.String(pair.GetValue())})
+			}
+			sort.Slice(metric.Label, func(i, j int) bool { return metric.Label[i].GetName() < metric.Label[j].GetName() })
+		}
+	}
+	return families, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseConstLabels(t *testing.T) {
+	environ := []string{"PATH=/bin", constLabelEnvPrefix + "SITE=fra", constLabelEnvPrefix + "ENV=prod"}
+	labels, err := parseConstLabels([]string{"env=test", "node=a=b"}, environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// names from the environment are lower-cased, flags win over the environment
+	expected := map[string]string{"site": "fra", "env": "test", "node": "a=b"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("got %v, want %v", labels, expected)
+	}
+}
+
+func TestParseConstLabelsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []string
+		environ []string
+		err     string
+	}{
+		{"no value", []string{"site"}, nil, "expected key=value"},
+		{"empty value", []string{"site="}, nil, "the value of site is empty"},
+		{"invalid name", []string{"1site=fra"}, nil, "invalid label name"},
+		{"reserved name", []string{"__name__=x"}, nil, "invalid label name"},
+		{"repeated flag", []string{"site=fra", "site=ber"}, nil, "site is defined more than once"},
+		{"invalid environment", nil, []string{constLabelEnvPrefix + "SITE-ID=1"}, "environment variable " + constLabelEnvPrefix + "SITE-ID"},
+	}
+	for _, test := range tests {
+		if _, err := parseConstLabels(test.flags, test.environ); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestConstLabelClashes(t *testing.T) {
+	tests := []struct {
+		args  []string
+		clash bool
+	}{
+		{[]string{"--label", "site=fra"}, false},
+		// a label of the built-in mappings
+		{[]string{"--label", "code=x"}, true},
+		// labels of the exporter's own metrics
+		{[]string{"--label", "collector=x"}, true},
+		{[]string{"--label", "group=x"}, false},
+		{[]string{"--catchAll", catchAllLabels, "--label", "group=x"}, true},
+	}
+	for _, test := range tests {
+		_, err := loadConfiguration(newTestContext(t, test.args...))
+		if clash := err != nil && strings.Contains(err.Error(), "clashes"); clash != test.clash || (err != nil && !clash) {
+			t.Errorf("%v: got error %v, want a clash %v", test.args, err, test.clash)
+		}
+	}
+}
+
+func TestConstLabelGatherer(t *testing.T) {
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{{
+			Name: proto.String("kamailio_up"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Label: labelPairs(map[string]string{"site": "ber"}), Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+				{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			},
+		}}, nil
+	})
+	families, err := newConstLabelGatherer(gatherer, map[string]string{"site": "fra", "env": "prod"}).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the label of the metric itself wins, the labels stay sorted
+	for i, expected := range []map[string]string{{"env": "prod", "site": "ber"}, {"env": "prod", "site": "fra"}} {
+		if labels := families[0].Metric[i].Label; !reflect.DeepEqual(labels, labelPairs(expected)) {
+			t.Errorf("series #%d: got %v, want %v", i+1, labels, expected)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// actions of the --series.limitAction flag
+const (
+	seriesLimitFold = "fold"
+	seriesLimitDrop = "drop"
+)
+
+// series exceeding a limit are folded into a series with this value for all labels
+const otherLabelValue = "other"
+
+// the remaining stats of --catchAll count as a collector of this name
+const catchAllCollectorName = "catchall"
+
+var seriesLimited = prometheus.NewDesc(
+	"kamailio_exporter_series_limited_total",
+	"Series which exceeded a series limit and were folded or dropped",
+	[]string{"collector"}, nil)
+
+// series limits of the collectors and all collectors together, 0 means unlimited
+type seriesLimits struct {
+	global       int
+	perCollector int
+	// per collector limits of the config file, they win over perCollector
+	collectors map[string]int
+	action     string
+
+	// series limited so far per collector, shared by all scrapes
+	mu      sync.Mutex
+	limited map[string]float64
+}
+
+func newSeriesLimits(global int, perCollector int, collectors map[string]int, action string) (*seriesLimits, error) {
+	if action != seriesLimitFold && action != seriesLimitDrop {
+		return nil, fmt.Errorf("unknown series limit action %q, use one of fold or drop", action)
+	}
+	if global < 0 || perCollector < 0 {
+		return nil, fmt.Errorf("series limits must not be negative")
+	}
+	for name, limit := range collectors {
+		if name != catchAllCollectorName && !isRegisteredCollector(name) {
+			return nil, fmt.Errorf("series limit for unknown collector %q", name)
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("series limit of collector %s must not be negative", name)
+		}
+	}
+	return &seriesLimits{
+		global:       global,
+		perCollector: perCollector,
+		collectors:   collectors,
+		action:       action,
+		limited:      make(map[string]float64),
+	}, nil
+}
+
+// the series limit of a collector
+func (l *seriesLimits) collectorLimit(name string) int {
+	if limit, ok := l.collectors[name]; ok {
+		return limit
+	}
+	return l.perCollector
+}
+
+// add the limited series of a scrape and produce a kamailio_exporter_series_limited_total metric for each collector
+func (l *seriesLimits) produceMetrics(g *seriesGuard, collectors []string, metricChannel chan<- prometheus.Metric) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, name := range collectors {
+		l.limited[name] += float64(g.limited[name])
+		metricChannel <- prometheus.MustNewConstMetric(seriesLimited, prometheus.CounterValue, l.limited[name], name)
+	}
+}
+
+// a series folded into the "other" series of its family
+type foldedSeries struct {
+	labelCount int
+	valueType  prometheus.ValueType
+	value      float64
+}
+
+// enforces the series limits during a single scrape
+type seriesGuard struct {
+	limits *seriesLimits
+	// the collector producing metrics right now
+	collector string
+	total     int
+	series    map[string]int
+	limited   map[string]int
+	// the folded series of the current collector, in order of appearance
+	folded      map[*prometheus.Desc]*foldedSeries
+	foldedOrder []*prometheus.Desc
+}
+
+func newSeriesGuard(limits *seriesLimits) *seriesGuard {
+	return &seriesGuard{
+		limits:  limits,
+		series:  make(map[string]int),
+		limited: make(map[string]int),
+		folded:  make(map[*prometheus.Desc]*foldedSeries),
+	}
+}
+
+// check whether another series of the current collector is within the limits, and count it
+func (g *seriesGuard) admit() bool {
+	if g.limits.global > 0 && g.total >= g.limits.global {
+		return false
+	}
+	if limit := g.limits.collectorLimit(g.collector); limit > 0 && g.series[g.collector] >= limit {
+		return false
+	}
+	g.total++
+	g.series[g.collector]++
+	return true
+}
+
+// take care of a series which exceeded a limit
+func (g *seriesGuard) limit(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues []string) {
+	g.limited[g.collector]++
+	// series without labels can't be folded
+	if g.limits.action != seriesLimitFold || len(labelValues) == 0 {
+		return
+	}
+	g.fold(desc, valueType, value, len(labelValues))
+}
+
+// hold back an admitted series whose labels are all "other", flush produces it
+// together with the series folded into it, instead of a duplicate of it
+func (g *seriesGuard) holdOther(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues []string) bool {
+	if g.limits.action != seriesLimitFold || len(labelValues) == 0 {
+		return false
+	}
+	for _, labelValue := range labelValues {
+		if labelValue != otherLabelValue {
+			return false
+		}
+	}
+	g.fold(desc, valueType, value, len(labelValues))
+	return true
+}
+
+// add a value to the "other" series of a family
+func (g *seriesGuard) fold(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelCount int) {
+	folded, ok := g.folded[desc]
+	if !ok {
+		folded = &foldedSeries{labelCount: labelCount, valueType: valueType}
+		g.folded[desc] = folded
+		g.foldedOrder = append(g.foldedOrder, desc)
+	}
+	folded.value += value
+}
+
+// produce the "other" series of the current collector
+func (g *seriesGuard) flush(metricChannel chan<- prometheus.Metric) error {
+	defer func() {
+		g.folded = make(map[*prometheus.Desc]*foldedSeries)
+		g.foldedOrder = nil
+	}()
+	for _, desc := range g.foldedOrder {
+		folded := g.folded[desc]
+		labelValues := make([]string, folded.labelCount)
+		for i := range labelValues {
+			labelValues[i] = otherLabelValue
+		}
+		metric, err := prometheus.NewConstMetric(desc, folded.valueType, folded.value, labelValues...)
+		if err != nil {
+			return err
+		}
+		metricChannel <- metric
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// the value of every series produced by a collector, by label value
+func collectSeries(t *testing.T, limits *seriesLimits, produce func(s *scrape, metricChannel chan<- prometheus.Metric)) map[string]float64 {
+	t.Helper()
+	metricChannel := make(chan prometheus.Metric, 100)
+	s := newScrape(nil, limits)
+	s.startCollector("htable")
+	produce(s, metricChannel)
+	s.finishCollector(metricChannel)
+	close(metricChannel)
+
+	series := make(map[string]float64)
+	for metric := range metricChannel {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		value := m.Label[0].GetValue()
+		if _, ok := series[value]; ok {
+			t.Errorf("duplicate series %s", value)
+		}
+		series[value] = m.Gauge.GetValue()
+	}
+	return series
+}
+
+func TestSeriesGuardFold(t *testing.T) {
+	desc := prometheus.NewDesc("kamailio_carrier_calls", "Calls by carrier", []string{"carrier"}, nil)
+	limits, err := newSeriesLimits(0, 2, nil, seriesLimitFold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		carriers []string
+		series   map[string]float64
+	}{
+		{"within the limit", []string{"a", "b"}, map[string]float64{"a": 1, "b": 2}},
+		{"folded", []string{"a", "b", "c", "d"}, map[string]float64{"a": 1, "b": 2, "other": 7}},
+		// a real "other" carrier is merged with the folded series instead of duplicating them
+		{"admitted other", []string{"other", "b", "c", "d"}, map[string]float64{"other": 8, "b": 2}},
+		{"limited other", []string{"a", "b", "other", "d"}, map[string]float64{"a": 1, "b": 2, "other": 7}},
+		{"only other", []string{"other"}, map[string]float64{"other": 1}},
+	}
+	for _, test := range tests {
+		series := collectSeries(t, limits, func(s *scrape, metricChannel chan<- prometheus.Metric) {
+			for i, carrier := range test.carriers {
+				if err := s.sendMetric(metricChannel, desc, prometheus.GaugeValue, float64(i+1), carrier); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		if len(series) != len(test.series) {
+			t.Errorf("%s: got %v, want %v", test.name, series, test.series)
+			continue
+		}
+		for carrier, value := range test.series {
+			if series[carrier] != value {
+				t.Errorf("%s: got %v, want %v", test.name, series, test.series)
+				break
+			}
+		}
+	}
+}
+
+func TestSeriesGuardDrop(t *testing.T) {
+	desc := prometheus.NewDesc("kamailio_carrier_calls", "Calls by carrier", []string{"carrier"}, nil)
+	limits, err := newSeriesLimits(0, 2, nil, seriesLimitDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := collectSeries(t, limits, func(s *scrape, metricChannel chan<- prometheus.Metric) {
+		for i, carrier := range []string{"other", "b", "c"} {
+			if err := s.sendMetric(metricChannel, desc, prometheus.GaugeValue, float64(i+1), carrier); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if len(series) != 2 || series["other"] != 1 || series["b"] != 2 {
+		t.Errorf("got %v, want other and b", series)
+	}
+}
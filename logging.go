@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// repeated warnings (e.g. kamailio being unreachable) are only logged
+// once per interval, see configureLogging
+var warnLimiter = newLogLimiter(time.Minute)
+
+// apply the --log.* cli flags to the standard logger
+func configureLogging(c *cli.Context) error {
+	switch c.String("log.format") {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "logfmt":
+		// logrus' text formatter writes logfmt as long as colors are off
+		log.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, use one of text, logfmt or json", c.String("log.format"))
+	}
+
+	level, err := log.ParseLevel(c.String("log.level"))
+	if err != nil {
+		return err
+	}
+	// --debug is kept for backwards compatibility and wins over --log.level
+	if c.Bool("debug") {
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+
+	warnLimiter.interval = c.Duration("log.repeatInterval")
+	return nil
+}
+
+// logLimiter suppresses identical log messages for a while
+type logLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       map[string]time.Time
+	suppressed map[string]int
+	// keys are evicted at most once per interval, see evict
+	lastEviction time.Time
+	// replaced by tests
+	now func() time.Time
+}
+
+func newLogLimiter(interval time.Duration) *logLimiter {
+	return &logLimiter{
+		interval:   interval,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		now:        time.Now,
+	}
+}
+
+// forget the keys not logged within the interval, they would be let through anyway,
+// only the count of their suppressed messages is lost
+// keys are per stat or htable entry, without eviction the maps would grow for the life of the process
+func (l *logLimiter) evict(now time.Time) {
+	if now.Sub(l.lastEviction) < l.interval {
+		return
+	}
+	l.lastEviction = now
+	for key, last := range l.last {
+		if now.Sub(last) >= l.interval {
+			delete(l.last, key)
+			delete(l.suppressed, key)
+		}
+	}
+}
+
+// check wether a message identified by key may be logged now
+// the number of suppressed messages since the last one is returned as well
+func (l *logLimiter) allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if last, ok := l.last[key]; ok && now.Sub(last) < l.interval {
+		l.suppressed[key]++
+		return false, 0
+	}
+	suppressed := l.suppressed[key]
+	delete(l.suppressed, key)
+	l.evict(now)
+	l.last[key] = now
+	return true, suppressed
+}
+
+// log a warning unless the same key was logged within the interval
+func (l *logLimiter) Warnf(logger *log.Entry, key string, format string, args ...interface{}) {
+	if ok, suppressed := l.allow(key); ok {
+		if suppressed > 0 {
+			logger = logger.WithField("suppressed", suppressed)
+		}
+		logger.Warnf(format, args...)
+	}
+}
+
+// log an error unless the same key was logged within the interval
+func (l *logLimiter) Errorf(logger *log.Entry, key string, format string, args ...interface{}) {
+	if ok, suppressed := l.allow(key); ok {
+		if suppressed > 0 {
+			logger = logger.WithField("suppressed", suppressed)
+		}
+		logger.Errorf(format, args...)
+	}
+}
+
+// http handler to read (GET) or change (PUT/POST, form value "level") the log level at runtime
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := log.ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetLevel(level)
+		log.WithField("remote", r.RemoteAddr).Infof("Log level changed to %s", level)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, log.GetLevel())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// a limiter with a clock under control of the test
+func newTestLogLimiter(interval time.Duration) (*logLimiter, *time.Time) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newLogLimiter(interval)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestLogLimiterSuppression(t *testing.T) {
+	limiter, now := newTestLogLimiter(time.Minute)
+	logger, hook := test.NewNullLogger()
+	entry := log.NewEntry(logger)
+
+	for i := 0; i < 4; i++ {
+		limiter.Warnf(entry, "a", "warning %d", i)
+	}
+	// other keys are independent
+	limiter.Errorf(entry, "b", "error")
+	if len(hook.Entries) != 2 {
+		t.Fatalf("got %d messages, want 2", len(hook.Entries))
+	}
+	if _, ok := hook.Entries[0].Data["suppressed"]; ok {
+		t.Errorf("the first message has a suppressed count")
+	}
+	if hook.Entries[1].Level != log.ErrorLevel {
+		t.Errorf("got level %s, want error", hook.Entries[1].Level)
+	}
+
+	*now = now.Add(59 * time.Second)
+	limiter.Warnf(entry, "a", "still suppressed")
+	*now = now.Add(time.Second)
+	limiter.Warnf(entry, "a", "warning again")
+	if len(hook.Entries) != 3 {
+		t.Fatalf("got %d messages, want 3", len(hook.Entries))
+	}
+	last := hook.LastEntry()
+	if last.Message != "warning again" || last.Data["suppressed"] != 4 {
+		t.Errorf("got %q with %v suppressed, want 4 suppressed", last.Message, last.Data["suppressed"])
+	}
+}
+
+func TestLogLimiterEviction(t *testing.T) {
+	limiter, now := newTestLogLimiter(time.Minute)
+	entry := log.NewEntry(log.New())
+	entry.Logger.SetLevel(log.PanicLevel)
+
+	for _, key := range []string{"htable:t:a", "htable:t:b", "htable:t:c"} {
+		limiter.Warnf(entry, key, "warning")
+	}
+	limiter.Warnf(entry, "htable:t:a", "suppressed")
+	*now = now.Add(30 * time.Second)
+	limiter.Warnf(entry, "htable:t:d", "warning")
+	if len(limiter.last) != 4 {
+		t.Errorf("got %d keys, want 4", len(limiter.last))
+	}
+
+	// keys older than the interval are evicted when the next message is let through
+	*now = now.Add(45 * time.Second)
+	limiter.Warnf(entry, "htable:t:e", "warning")
+	if len(limiter.last) != 2 || len(limiter.suppressed) != 0 {
+		t.Errorf("got keys %v and suppressed %v, want d and e only", limiter.last, limiter.suppressed)
+	}
+	if _, ok := limiter.last["htable:t:d"]; !ok {
+		t.Errorf("evicted a key logged within the interval")
+	}
+}
@@ -2,12 +2,11 @@ package main
 
 import (
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/urfave/cli.v1"
 	"net/http"
 	"os"
+	"time"
 )
 
 var Version string
@@ -17,13 +16,41 @@ func main() {
 	app.Name = "Kamailio exporter"
 	app.Usage = "Expose Kamailio statistics as http endpoint for prometheus."
 	app.Version = Version
-	// define cli flags
-	app.Flags = []cli.Flag{
+	app.Flags = appFlags()
+	app.Action = appAction
+	// then start the application
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// the cli flags
+func appFlags() []cli.Flag {
+	flags := []cli.Flag{
 		cli.BoolFlag{
 			Name:   "debug",
-			Usage:  "Enable debug logging",
+			Usage:  "Enable debug logging, same as --log.level=debug",
 			EnvVar: "DEBUG",
 		},
+		cli.StringFlag{
+			Name:   "log.level",
+			Value:  "info",
+			Usage:  "Log level, one of debug, info, warn, error",
+			EnvVar: "LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log.format",
+			Value:  "text",
+			Usage:  "Log format, one of text, logfmt, json",
+			EnvVar: "LOG_FORMAT",
+		},
+		cli.DurationFlag{
+			Name:   "log.repeatInterval",
+			Value:  time.Minute,
+			Usage:  "Log identical warnings only once within this interval",
+			EnvVar: "LOG_REPEAT_INTERVAL",
+		},
 		cli.StringFlag{
 			Name:   "socketPath",
 			Value:  "/var/run/kamailio/kamailio_ctl",
@@ -41,6 +68,60 @@ func main() {
 			Usage:  "Kamailio port",
 			EnvVar: "PORT",
 		},
+		cli.StringFlag{
+			Name:   "mappingFile",
+			Usage:  "YAML file mapping kamailio stats to metrics. The built-in mappings are used if no file is defined.",
+			EnvVar: "MAPPING_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "Constant label added to every metric, as key=value. Can be repeated. Environment variables " + constLabelEnvPrefix + "<KEY>=value work as well",
+		},
+		cli.StringFlag{
+			Name:   "configFile",
+			Usage:  "YAML file with further exporter settings, e.g. metric relabeling rules",
+			EnvVar: "CONFIG_FILE",
+		},
+		cli.StringFlag{
+			Name:   "metrics.schema",
+			Value:  "v1",
+			Usage:  "Version of the built-in metric names and types. One of v1, v2 (corrected names and types)",
+			EnvVar: "METRICS_SCHEMA",
+		},
+		cli.StringFlag{
+			Name:   "metrics.compat",
+			Value:  "none",
+			Usage:  "Emit the metric names of another exporter to ease migrations. One of none, florent (github.com/florentchauveau/kamailio_exporter)",
+			EnvVar: "METRICS_COMPAT",
+		},
+		cli.StringFlag{
+			Name:   "catchAll",
+			Value:  "off",
+			Usage:  "Export all stats not covered by the mappings, either as kamailio_stat{group,name} (labels) or as kamailio_<group>_<name> (names). One of off, labels, names",
+			EnvVar: "CATCH_ALL",
+		},
+		cli.StringFlag{
+			Name:   "scripted.labelSeparator",
+			Value:  "__",
+			Usage:  "Separator of the label names and values encoded in scripted stat names, e.g. calls_total__carrier__a. Empty to disable labels",
+			EnvVar: "SCRIPTED_LABEL_SEPARATOR",
+		},
+		cli.IntFlag{
+			Name:   "series.limit",
+			Usage:  "Maximum number of series of all collectors together, 0 for no limit",
+			EnvVar: "SERIES_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "series.collectorLimit",
+			Usage:  "Maximum number of series of a single collector, 0 for no limit",
+			EnvVar: "SERIES_COLLECTOR_LIMIT",
+		},
+		cli.StringFlag{
+			Name:   "series.limitAction",
+			Value:  "fold",
+			Usage:  "What happens to series exceeding a limit. One of fold (into a series labelled \"other\"), drop",
+			EnvVar: "SERIES_LIMIT_ACTION",
+		},
 		cli.StringFlag{
 			Name:   "bindIp",
 			Value:  "0.0.0.0",
@@ -60,46 +141,33 @@ func main() {
 			EnvVar: "METRICS_PATH",
 		},
 	}
-	app.Action = appAction
-	// then start the application
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// and one flag pair for each collector
+	return append(flags, collectorFlags()...)
 }
 
 // start the application
 func appAction(c *cli.Context) error {
-	log.Info("Starting kamailio exporter")
-
-	if c.Bool("debug") {
-		log.SetLevel(log.DebugLevel)
-		log.Debug("Debug logging is enabled")
+	if err := configureLogging(c); err != nil {
+		return err
 	}
+	log.Info("Starting kamailio exporter")
+	log.Debug("Debug logging is enabled")
+	log.Debugf("Using known stats registry version %s", knownStatsVersion)
 
-	// create a collector
-	collector, err := NewStatsCollector(c)
+	// the collectors and metric endpoints, replaced on every reload
+	reloader, err := newReloader(c)
 	if err != nil {
 		return err
 	}
-	// and register it in prometheus API
-	prometheus.MustRegister(collector)
+	reloader.watchSignals()
 
 	metricsPath := c.String("metricsPath")
 	listenAddress := fmt.Sprintf("%s:%d", c.String("bindIp"), c.Int("bindPort"))
-	// wire "/" to return some helpful info
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>Kamailio Exporter</title></head>
-             <body>
-			 <p>This is a prometheus metric exporter for Kamailio.</p>
-			 <p>Browse <a href='` + metricsPath + `'>` + metricsPath + `</a> 
-			 to get the metrics.</p>
-             </body>
-             </html>`))
-	})
-	// wire "/metrics" -> prometheus API collectors
-	http.HandleFunc(metricsPath, promhttp.Handler().ServeHTTP)
+	http.Handle("/", reloader)
+	// wire "/-/reload" to reload the configuration, same as SIGHUP
+	http.HandleFunc("/-/reload", reloader.reloadHandler)
+	// wire "/-/log-level" to read or change the log level at runtime
+	http.HandleFunc("/-/log-level", logLevelHandler)
 
 	// start http server
 	log.Info("Listening on ", listenAddress, metricsPath)
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// versions of the metric schema, see --metrics.schema
+const (
+	schemaV1 = "v1"
+	schemaV2 = "v2"
+)
+
+// the mapping files shipped with the exporter, one per metric schema
+var (
+	//go:embed mappings.yml
+	defaultMappings []byte
+
+	//go:embed mappings_v2.yml
+	v2Mappings []byte
+)
+
+var (
+	metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// a metric family as declared in a mapping file
+type metricMappingConfig struct {
+	Name      string              `yaml:"name"`
+	Help      string              `yaml:"help"`
+	Type      string              `yaml:"type"`
+	Label     string              `yaml:"label"`
+	Collector string              `yaml:"collector"`
+	Stats     []statMappingConfig `yaml:"stats"`
+}
+
+// a single stat (or a pattern of stats) as declared in a mapping file
+type statMappingConfig struct {
+	Key      string `yaml:"key"`
+	Pattern  string `yaml:"pattern"`
+	Regex    string `yaml:"regex"`
+	Template string `yaml:"template"`
+	Value    string `yaml:"value"`
+}
+
+// a validated metric family, ready to be used for each scrape
+type metricMapping struct {
+	name        string
+	collector   string
+	valueType   prometheus.ValueType
+	label       string
+	description *prometheus.Desc
+	stats       []*statMapping
+}
+
+// a validated stat mapping, either an exact key or
+// a glob pattern, regex or template matching any number of stats
+type statMapping struct {
+	key     string
+	pattern string
+	// regex and template mappings are both turned into a regexp
+	regex *regexp.Regexp
+	// the label value, may refer to regexp groups like "$1" or "${code}"
+	value string
+}
+
+// placeholders like "{code}" in template mappings
+var templatePlaceholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// the built-in mappings of a metric schema and compatibility mode
+func builtinMappings(schema string, compat string) ([]byte, error) {
+	switch compat {
+	case compatNone:
+	case compatFlorent:
+		if schema != schemaV1 {
+			return nil, fmt.Errorf("compatibility mode %s can't be combined with metric schema %s", compat, schema)
+		}
+		return florentMappings, nil
+	default:
+		return nil, fmt.Errorf("unknown compatibility mode %q, use one of none or florent", compat)
+	}
+	switch schema {
+	case schemaV1:
+		return defaultMappings, nil
+	case schemaV2:
+		return v2Mappings, nil
+	}
+	return nil, fmt.Errorf("unknown metric schema %q, use one of v1 or v2", schema)
+}
+
+// load the mapping file, the built-in mappings are used if fileName is empty
+func loadMappings(fileName string, builtin []byte) ([]*metricMapping, error) {
+	content := builtin
+	source := "built-in mappings"
+	if fileName != "" {
+		var err error
+		if content, err = ioutil.ReadFile(fileName); err != nil {
+			return nil, err
+		}
+		source = fileName
+	}
+	// the built-in v1 mappings keep their historic types, only mapping files are checked
+	mappings, err := parseMappings(content, fileName != "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	return mappings, nil
+}
+
+// parse and validate a mapping file
+// errors are reported with the line number of the offending entry
+// checkTypes reports stats exported with another type than the known kamailio stat
+func parseMappings(content []byte, checkTypes bool) ([]*metricMapping, error) {
+	// a strict decode first, it reports syntax errors and unknown fields
+	var strict struct {
+		Metrics []metricMappingConfig `yaml:"metrics"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&strict); err != nil {
+		return nil, err
+	}
+	// then keep the yaml nodes to know the line of each metric
+	var document struct {
+		Metrics []yaml.Node `yaml:"metrics"`
+	}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+
+	var mappings []*metricMapping
+	names := make(map[string]int)
+	for _, node := range document.Metrics {
+		var config metricMappingConfig
+		if err := node.Decode(&config); err != nil {
+			return nil, err
+		}
+		if line, ok := names[config.Name]; ok {
+			return nil, fmt.Errorf("line %d: metric %q is already declared in line %d", node.Line, config.Name, line)
+		}
+		names[config.Name] = node.Line
+		mapping, err := newMetricMapping(config)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: metric %q: %s", node.Line, config.Name, err)
+		}
+		if checkTypes {
+			checkMappingTypes(node.Line, mapping)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// validate a metric family and create its description
+func newMetricMapping(config metricMappingConfig) (*metricMapping, error) {
+	if !metricNameRegexp.MatchString(config.Name) {
+		return nil, fmt.Errorf("invalid metric name")
+	}
+	if config.Help == "" {
+		return nil, fmt.Errorf("help is missing")
+	}
+	valueType, err := mappingValueType(config)
+	if err != nil {
+		return nil, err
+	}
+	labelNames := []string{}
+	if config.Label != "" {
+		if !labelNameRegexp.MatchString(config.Label) {
+			return nil, fmt.Errorf("invalid label name %q", config.Label)
+		}
+		labelNames = []string{config.Label}
+	}
+	if len(config.Stats) == 0 {
+		return nil, fmt.Errorf("no stats declared")
+	}
+	collector := config.Collector
+	if collector == "" {
+		collector = mappingGroup(config.Stats[0])
+	}
+	if !isMappingCollector(collector) {
+		return nil, fmt.Errorf("unknown collector %q, use one of %s", collector, strings.Join(mappingCollectorNames(), ", "))
+	}
+
+	values := make(map[string]bool)
+	var stats []*statMapping
+	for i, statConfig := range config.Stats {
+		stat, err := newStatMapping(statConfig, labelNames)
+		if err != nil {
+			return nil, fmt.Errorf("stat #%d: %s", i+1, err)
+		}
+		if stat.key != "" && len(labelNames) == 0 && len(config.Stats) > 1 {
+			return nil, fmt.Errorf("stat #%d: metrics without label can only export a single stat", i+1)
+		}
+		if stat.key != "" && stat.value != "" {
+			if values[stat.value] {
+				return nil, fmt.Errorf("stat #%d: label value %q is used more than once", i+1, stat.value)
+			}
+			values[stat.value] = true
+		}
+		stats = append(stats, stat)
+	}
+
+	return &metricMapping{
+		name:        config.Name,
+		collector:   collector,
+		valueType:   valueType,
+		label:       config.Label,
+		description: prometheus.NewDesc(config.Name, config.Help, labelNames, nil),
+		stats:       stats,
+	}, nil
+}
+
+// validate a single stat mapping of a metric family with the given labels
+func newStatMapping(config statMappingConfig, labelNames []string) (*statMapping, error) {
+	declared := 0
+	for _, field := range []string{config.Key, config.Pattern, config.Regex, config.Template} {
+		if field != "" {
+			declared++
+		}
+	}
+	if declared != 1 {
+		return nil, fmt.Errorf("use exactly one of key, pattern, regex or template")
+	}
+	if len(labelNames) == 0 && config.Value != "" {
+		return nil, fmt.Errorf("label value given, but no label declared")
+	}
+	if len(labelNames) == 0 && config.Key == "" {
+		return nil, fmt.Errorf("patterns need a label to distinguish the matched stats")
+	}
+
+	stat := &statMapping{key: config.Key, pattern: config.Pattern, value: config.Value}
+	switch {
+	case config.Key != "":
+		if len(labelNames) > 0 && config.Value == "" {
+			return nil, fmt.Errorf("label value for %s is missing", config.Key)
+		}
+	case config.Pattern != "":
+		if _, err := path.Match(config.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", config.Pattern, err)
+		}
+		if config.Value != "" {
+			return nil, fmt.Errorf("patterns take the label value from the stat name")
+		}
+	case config.Regex != "":
+		regex, err := regexp.Compile("^(?:" + config.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %s", config.Regex, err)
+		}
+		if config.Value == "" {
+			return nil, fmt.Errorf("label value for regex %q is missing, e.g. \"$1\"", config.Regex)
+		}
+		stat.regex = regex
+	case config.Template != "":
+		regex, value, err := compileTemplate(config.Template, labelNames[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %s", config.Template, err)
+		}
+		if stat.value == "" {
+			stat.value = value
+		}
+		if stat.value == "" {
+			return nil, fmt.Errorf("label value for template %q is missing, e.g. \"${%s}\"", config.Template, labelNames[0])
+		}
+		stat.regex = regex
+	}
+	return stat, nil
+}
+
+// turn a template like "sl.{code}_replies" into an anchored regexp with named groups
+// the label value defaults to the placeholder named like the label
+func compileTemplate(template string, labelName string) (*regexp.Regexp, string, error) {
+	var expr strings.Builder
+	value := ""
+	names := make(map[string]bool)
+	last := 0
+	for _, loc := range templatePlaceholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		name := template[loc[2]:loc[3]]
+		if !labelNameRegexp.MatchString(name) {
+			return nil, "", fmt.Errorf("invalid placeholder {%s}", name)
+		}
+		if names[name] {
+			return nil, "", fmt.Errorf("placeholder {%s} is used more than once", name)
+		}
+		names[name] = true
+		if name == labelName {
+			value = "${" + name + "}"
+		}
+		expr.WriteString(regexp.QuoteMeta(template[last:loc[0]]))
+		expr.WriteString("(?P<" + name + ">[^.]+?)")
+		last = loc[1]
+	}
+	if len(names) == 0 {
+		return nil, "", fmt.Errorf("no placeholder found")
+	}
+	expr.WriteString(regexp.QuoteMeta(template[last:]))
+	regex, err := regexp.Compile("^" + expr.String() + "$")
+	return regex, value, err
+}
+
+// the stats of completeStatMap matched by a pattern, regex or template mapping and their label values
+// keys are sorted for a stable output
+func (stat *statMapping) matchingStats(completeStatMap map[string]string) ([]string, []string) {
+	var keys []string
+	for key := range completeStatMap {
+		if stat.regex != nil && stat.regex.MatchString(key) {
+			keys = append(keys, key)
+		} else if ok, _ := path.Match(stat.pattern, key); ok && stat.pattern != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	labelValues := make([]string, len(keys))
+	for i, key := range keys {
+		if stat.regex == nil {
+			labelValues[i] = patternLabelValue(key)
+			continue
+		}
+		match := stat.regex.FindStringSubmatchIndex(key)
+		labelValues[i] = string(stat.regex.ExpandString(nil, stat.value, key, match))
+	}
+	return keys, labelValues
+}
+
+// the stat group of a stat mapping, e.g. "sl" for "sl.{code}_replies"
+// used as collector of mappings without an explicit one
+func mappingGroup(config statMappingConfig) string {
+	for _, key := range []string{config.Key, config.Pattern, config.Template} {
+		if i := strings.Index(key, "."); i > 0 {
+			return key[:i]
+		}
+	}
+	return ""
+}
+
+// check wether a stat is covered by any of the mappings
+func isMappedStat(mappings []*metricMapping, key string) bool {
+	for _, mapping := range mappings {
+		for _, stat := range mapping.stats {
+			if stat.key == key || (stat.regex != nil && stat.regex.MatchString(key)) {
+				return true
+			}
+			if ok, _ := path.Match(stat.pattern, key); ok && stat.pattern != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// the type of a metric family, either declared or derived from the known stats
+func mappingValueType(config metricMappingConfig) (prometheus.ValueType, error) {
+	switch config.Type {
+	case "counter":
+		return prometheus.CounterValue, nil
+	case "gauge":
+		return prometheus.GaugeValue, nil
+	case "":
+	default:
+		return 0, fmt.Errorf("invalid type %q, use counter or gauge", config.Type)
+	}
+
+	var valueType prometheus.ValueType
+	for i, stat := range config.Stats {
+		if stat.Regex != "" || stat.Template != "" {
+			return 0, fmt.Errorf("stat #%d: type is missing, it can't be derived for regex and template mappings", i+1)
+		}
+		key := stat.Key
+		if key == "" {
+			key = stat.Pattern
+		}
+		known, ok := lookupKnownStat(key)
+		if !ok {
+			return 0, fmt.Errorf("stat #%d: type is missing and %s is not a known kamailio stat", i+1, key)
+		}
+		if valueType != 0 && known.valueType != valueType {
+			return 0, fmt.Errorf("stat #%d: type is missing and the stats are of mixed types", i+1)
+		}
+		valueType = known.valueType
+	}
+	return valueType, nil
+}
+
+// report stats whose declared type differs from the known kamailio stat
+// exporting a counter as gauge loses nothing, the other way round breaks rate() and friends
+func checkMappingTypes(line int, mapping *metricMapping) {
+	for _, stat := range mapping.stats {
+		known, ok := lookupKnownStat(stat.key)
+		if stat.key == "" || !ok || known.valueType == mapping.valueType {
+			continue
+		}
+		if known.valueType == prometheus.GaugeValue {
+			log.Warnf("Mapping line %d: metric %q exports gauge %s as counter", line, mapping.name, stat.key)
+		} else {
+			log.Debugf("Mapping line %d: metric %q exports counter %s as gauge", line, mapping.name, stat.key)
+		}
+	}
+}
+
+// the label value of a stat matched by a pattern is the stat name without group
+func patternLabelValue(statKey string) string {
+	if i := strings.Index(statKey, "."); i >= 0 {
+		return statKey[i+1:]
+	}
+	return statKey
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "update the expected metrics in testdata")
+
+func TestCompileTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		label    string
+		regex    string
+		value    string
+		err      bool
+	}{
+		{"usrloc.{table}-contacts", "table", `^usrloc\.(?P<table>[^.]+?)-contacts$`, "${table}", false},
+		{"core.rcv_requests_{method}", "method", `^core\.rcv_requests_(?P<method>[^.]+?)$`, "${method}", false},
+		{"app.{dir}_{code}_calls", "code", `^app\.(?P<dir>[^.]+?)_(?P<code>[^.]+?)_calls$`, "${code}", false},
+		// a placeholder not named like the label needs an explicit value
+		{"usrloc.{table}-contacts", "location", `^usrloc\.(?P<table>[^.]+?)-contacts$`, "", false},
+		{"usrloc.location-contacts", "table", "", "", true},
+		{"usrloc.{1table}-contacts", "table", "", "", true},
+		{"app.{code}_{code}", "code", "", "", true},
+	}
+	for _, test := range tests {
+		regex, value, err := compileTemplate(test.template, test.label)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.template, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if regex.String() != test.regex || value != test.value {
+			t.Errorf("%s: got %s %q, want %s %q", test.template, regex, value, test.regex, test.value)
+		}
+	}
+}
+
+func TestNewStatMappingErrors(t *testing.T) {
+	label := []string{"code"}
+	tests := []struct {
+		name       string
+		config     statMappingConfig
+		labelNames []string
+	}{
+		{"nothing", statMappingConfig{}, label},
+		{"key and regex", statMappingConfig{Key: "sl.200_replies", Regex: `sl\.200_replies`, Value: "200"}, label},
+		{"value without label", statMappingConfig{Key: "sl.failures", Value: "x"}, nil},
+		{"pattern without label", statMappingConfig{Pattern: "sl.*"}, nil},
+		{"key without value", statMappingConfig{Key: "sl.200_replies"}, label},
+		{"invalid pattern", statMappingConfig{Pattern: "sl.[_replies"}, label},
+		{"pattern with value", statMappingConfig{Pattern: "sl.*", Value: "x"}, label},
+		{"invalid regex", statMappingConfig{Regex: `sl\.(\d{3}_replies`, Value: "$1"}, label},
+		{"regex without value", statMappingConfig{Regex: `sl\.(\d{3})_replies`}, label},
+		{"template without value", statMappingConfig{Template: "usrloc.{table}-users"}, label},
+	}
+	for _, test := range tests {
+		if _, err := newStatMapping(test.config, test.labelNames); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestMatchingStats(t *testing.T) {
+	stats := readStatsFixture(t)
+	tests := []struct {
+		config statMappingConfig
+		label  string
+		keys   []string
+		values []string
+	}{
+		{
+			statMappingConfig{Regex: `tmx\.(\dxx)_transactions`, Value: "$1"}, "code",
+			[]string{"tmx.2xx_transactions", "tmx.3xx_transactions", "tmx.4xx_transactions", "tmx.5xx_transactions", "tmx.6xx_transactions"},
+			[]string{"2xx", "3xx", "4xx", "5xx", "6xx"},
+		},
+		{
+			// the regex is anchored, "sl.xxx_replies" and "sl.sent_replies" don't match
+			statMappingConfig{Regex: `sl\.(\d{3}|\dxx)_replies`, Value: "$1"}, "code",
+			[]string{"sl.1xx_replies", "sl.200_replies", "sl.202_replies", "sl.2xx_replies", "sl.300_replies", "sl.301_replies", "sl.302_replies", "sl.3xx_replies",
+				"sl.400_replies", "sl.401_replies", "sl.403_replies", "sl.404_replies", "sl.407_replies", "sl.408_replies", "sl.483_replies", "sl.4xx_replies",
+				"sl.500_replies", "sl.5xx_replies", "sl.6xx_replies"},
+			[]string{"1xx", "200", "202", "2xx", "300", "301", "302", "3xx", "400", "401", "403", "404", "407", "408", "483", "4xx", "500", "5xx", "6xx"},
+		},
+		{
+			statMappingConfig{Regex: `dialog\.(\w+)_dialogs`, Value: "dialog_$1"}, "state",
+			[]string{"dialog.active_dialogs", "dialog.early_dialogs", "dialog.expired_dialogs", "dialog.failed_dialogs", "dialog.processed_dialogs"},
+			[]string{"dialog_active", "dialog_early", "dialog_expired", "dialog_failed", "dialog_processed"},
+		},
+		{
+			statMappingConfig{Template: "usrloc.{table}-contacts"}, "table",
+			[]string{"usrloc.location-contacts"},
+			[]string{"location"},
+		},
+		{
+			statMappingConfig{Template: "usrloc.{table}-{kind}", Value: "${table}/${kind}"}, "table",
+			[]string{"usrloc.location-contacts", "usrloc.location-expires", "usrloc.location-users"},
+			[]string{"location/contacts", "location/expires", "location/users"},
+		},
+		{
+			statMappingConfig{Pattern: "dns.*"}, "type",
+			[]string{"dns.failed_dns_request", "dns.slow_dns_request"},
+			[]string{"failed_dns_request", "slow_dns_request"},
+		},
+	}
+	for _, test := range tests {
+		stat, err := newStatMapping(test.config, []string{test.label})
+		if err != nil {
+			t.Errorf("%+v: %s", test.config, err)
+			continue
+		}
+		keys, values := stat.matchingStats(stats)
+		if !reflect.DeepEqual(keys, test.keys) || !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%+v: got %v %v, want %v %v", test.config, keys, values, test.keys, test.values)
+		}
+	}
+}
+
+func TestParseMappingsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"syntax", "metrics: [", "yaml"},
+		{"unknown field", "metrics:\n  - name: kamailio_sl_failures_total\n    helptext: Stateless failures\n", "field helptext not found"},
+		{
+			"duplicate name",
+			"metrics:\n" +
+				"  - { name: kamailio_sl_failures_total, help: Failures, stats: [{ key: sl.failures }] }\n" +
+				"  - { name: kamailio_sl_failures_total, help: Failures, stats: [{ key: sl.failures }] }\n",
+			"line 3: metric \"kamailio_sl_failures_total\" is already declared in line 2",
+		},
+		{"help missing", "metrics:\n  - { name: kamailio_sl_failures_total, stats: [{ key: sl.failures }] }\n", "line 2: metric \"kamailio_sl_failures_total\": help is missing"},
+		{"invalid name", "metrics:\n  - { name: kamailio-sl, help: Failures, stats: [{ key: sl.failures }] }\n", "invalid metric name"},
+		{"no stats", "metrics:\n  - { name: kamailio_sl_failures_total, help: Failures, type: counter }\n", "no stats declared"},
+		{
+			"several stats without label",
+			"metrics:\n  - { name: kamailio_sl_total, help: Replies, type: counter, stats: [{ key: sl.failures }, { key: sl.sent_replies }] }\n",
+			"stat #1: metrics without label can only export a single stat",
+		},
+		{
+			"repeated label value",
+			"metrics:\n  - { name: kamailio_sl_total, help: Replies, label: type, stats: [{ key: sl.failures, value: a }, { key: sl.sent_replies, value: a }] }\n",
+			"stat #2: label value \"a\" is used more than once",
+		},
+	}
+	for _, test := range tests {
+		if _, err := parseMappings([]byte(test.content), true); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLoadMappings(t *testing.T) {
+	// the built-in mappings are used without a mapping file
+	mappings, err := loadMappings("", defaultMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builtin, _ := parseMappings(defaultMappings, false)
+	if len(mappings) != len(builtin) {
+		t.Errorf("got %d mappings, want the %d built-in ones", len(mappings), len(builtin))
+	}
+
+	file, err := ioutil.TempFile("", "mappings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("metrics:\n  - { name: kamailio_sl_failures_total, help: Stateless failures, stats: [{ key: sl.failures }] }\n")
+	file.Close()
+	// a mapping file replaces them
+	mappings, err = loadMappings(file.Name(), defaultMappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 1 || mappings[0].name != "kamailio_sl_failures_total" || mappings[0].valueType != prometheus.CounterValue {
+		t.Errorf("got %v, want the metric of the mapping file", mappings)
+	}
+	// errors name the file
+	if _, err := loadMappings(file.Name()+".missing", defaultMappings); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	ioutil.WriteFile(file.Name(), []byte("metrics:\n  - { name: kamailio_sl_failures_total }\n"), 0644)
+	if _, err := loadMappings(file.Name(), defaultMappings); err == nil || !strings.HasPrefix(err.Error(), file.Name()+": line 2:") {
+		t.Errorf("got error %v, want one starting with the file name and line", err)
+	}
+}
+
+// the built-in mappings of all schemas and compatibility modes parse
+func TestBuiltinMappings(t *testing.T) {
+	for _, mode := range []struct{ schema, compat string }{{schemaV1, compatNone}, {schemaV2, compatNone}, {schemaV1, compatFlorent}} {
+		content, err := builtinMappings(mode.schema, mode.compat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseMappings(content, true); err != nil {
+			t.Errorf("schema %s compat %s: %s", mode.schema, mode.compat, err)
+		}
+	}
+}
+
+// the names, labels and types of --metrics.schema=v2, only counters end with "_total"
+func TestV2MappingNames(t *testing.T) {
+	mappings, err := parseMappings(v2Mappings, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name      string
+		label     string
+		valueType prometheus.ValueType
+	}{
+		{"kamailio_core_request_total", "method", prometheus.CounterValue},
+		{"kamailio_core_rcv_request_total", "method", prometheus.CounterValue},
+		{"kamailio_core_reply_total", "type", prometheus.CounterValue},
+		{"kamailio_core_rcv_reply_total", "code", prometheus.CounterValue},
+		{"kamailio_shm_bytes", "type", prometheus.GaugeValue},
+		{"kamailio_shm_fragments", "", prometheus.GaugeValue},
+		{"kamailio_dns_failed_request_total", "", prometheus.CounterValue},
+		{"kamailio_bad_uri_total", "", prometheus.CounterValue},
+		{"kamailio_bad_msg_hdr_total", "", prometheus.CounterValue},
+		{"kamailio_sl_reply_total", "code", prometheus.CounterValue},
+		{"kamailio_sl_type_total", "type", prometheus.CounterValue},
+		{"kamailio_tcp_total", "type", prometheus.CounterValue},
+		{"kamailio_tcp_connections", "", prometheus.GaugeValue},
+		{"kamailio_tcp_writequeue_bytes", "", prometheus.GaugeValue},
+		{"kamailio_tmx_code_total", "code", prometheus.CounterValue},
+		{"kamailio_tmx_transactions_total", "origin", prometheus.CounterValue},
+		{"kamailio_tmx_transactions", "state", prometheus.GaugeValue},
+		{"kamailio_tmx_rpl_total", "type", prometheus.CounterValue},
+		{"kamailio_dialogs", "state", prometheus.GaugeValue},
+		{"kamailio_dialogs_total", "result", prometheus.CounterValue},
+		{"kamailio_dialogs_processed_total", "", prometheus.CounterValue},
+		{"kamailio_registrar_registrations_total", "result", prometheus.CounterValue},
+		{"kamailio_registrar_expires_seconds", "type", prometheus.GaugeValue},
+		{"kamailio_registrar_max_contacts", "", prometheus.GaugeValue},
+		{"kamailio_usrloc_registered_users", "", prometheus.GaugeValue},
+		{"kamailio_usrloc_users", "table", prometheus.GaugeValue},
+		{"kamailio_usrloc_contacts", "table", prometheus.GaugeValue},
+		{"kamailio_usrloc_expired_contacts_total", "table", prometheus.CounterValue},
+	}
+	if len(mappings) != len(expected) {
+		t.Fatalf("got %d metrics, want %d", len(mappings), len(expected))
+	}
+	for i, mapping := range mappings {
+		if mapping.name != expected[i].name || mapping.label != expected[i].label || mapping.valueType != expected[i].valueType {
+			t.Errorf("metric #%d: got %s{%s} %v, want %s{%s} %v", i+1, mapping.name, mapping.label, mapping.valueType, expected[i].name, expected[i].label, expected[i].valueType)
+		}
+		if isCounter := mapping.valueType == prometheus.CounterValue; isCounter != strings.HasSuffix(mapping.name, "_total") {
+			t.Errorf("%s: only counters end with _total", mapping.name)
+		}
+	}
+}
+
+// the names and types of --metrics.compat=florent, counters carry a "_total" suffix like in that exporter
+func TestFlorentMappingNames(t *testing.T) {
+	mappings, err := parseMappings(florentMappings, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name      string
+		valueType prometheus.ValueType
+	}{
+		{"kamailio_core_shmmem_total", prometheus.GaugeValue},
+		{"kamailio_core_shmmem_free", prometheus.GaugeValue},
+		{"kamailio_core_shmmem_used", prometheus.GaugeValue},
+		{"kamailio_core_shmmem_real_used", prometheus.GaugeValue},
+		{"kamailio_core_shmmem_max_used", prometheus.GaugeValue},
+		{"kamailio_core_shmmem_fragments", prometheus.GaugeValue},
+		{"kamailio_sl_stats_codes_total", prometheus.CounterValue},
+		{"kamailio_tm_stats_codes_total", prometheus.CounterValue},
+		{"kamailio_tm_stats_current", prometheus.GaugeValue},
+		{"kamailio_tm_stats_total_local_total", prometheus.CounterValue},
+		{"kamailio_tm_stats_rpl_received_total", prometheus.CounterValue},
+		{"kamailio_tm_stats_rpl_generated_total", prometheus.CounterValue},
+		{"kamailio_tm_stats_rpl_sent_total", prometheus.CounterValue},
+		{"kamailio_dlg_stats_active_ongoing", prometheus.GaugeValue},
+	}
+	if len(mappings) != len(expected) {
+		t.Fatalf("got %d metrics, want %d", len(mappings), len(expected))
+	}
+	for i, mapping := range mappings {
+		if mapping.name != expected[i].name || mapping.valueType != expected[i].valueType {
+			t.Errorf("metric #%d: got %s %v, want %s %v", i+1, mapping.name, mapping.valueType, expected[i].name, expected[i].valueType)
+		}
+	}
+}
+
+// the metrics the built-in mappings produce from the fixture, by name, type and labels,
+// run with -update to rewrite testdata/mappings_*.txt after a change of the mappings
+func TestBuiltinMappingsOfFixture(t *testing.T) {
+	stats := readStatsFixture(t)
+	for _, mode := range []struct{ schema, compat, file string }{
+		{schemaV1, compatNone, "testdata/mappings_v1.txt"},
+		{schemaV2, compatNone, "testdata/mappings_v2.txt"},
+		{schemaV1, compatFlorent, "testdata/mappings_florent.txt"},
+	} {
+		content, err := builtinMappings(mode.schema, mode.compat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mappings, err := parseMappings(content, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		families := gatherFamilies(t, func(metricChannel chan<- prometheus.Metric) {
+			produceMetrics(newTestScrape(), mappings, stats, metricChannel)
+		})
+		var result bytes.Buffer
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(&result, family); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if *update {
+			if err := ioutil.WriteFile(mode.file, result.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(mode.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result.Bytes(), expected) {
+			t.Errorf("%s: the metrics differ, got\n%s", mode.file, result.String())
+		}
+	}
+}
+
+func TestNewMetricMappingCollector(t *testing.T) {
+	config := metricMappingConfig{Name: "kamailio_sl_failures_total", Help: "Stateless failures", Type: "counter", Stats: []statMappingConfig{{Key: "sl.failures"}}}
+	mapping, err := newMetricMapping(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.collector != "sl" {
+		t.Errorf("got collector %s, want the group of the stat", mapping.collector)
+	}
+	// only the collectors of the mapping file produce mappings
+	for _, collector := range []string{"scripted", "htable", "statsd", "websocket"} {
+		config.Collector = collector
+		if _, err := newMetricMapping(config); err == nil {
+			t.Errorf("collector %s: expected an error", collector)
+		}
+	}
+}
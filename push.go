@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// the push endpoint of the config file, kamailio scripts post observations to it,
+// e.g. with the http_async_client module
+type pushConfig struct {
+	// "/push" if omitted
+	Path string `yaml:"path"`
+	// by metric name without "kamailio_", only declared metrics are accepted
+	Metrics map[string]*pushMetricConfig `yaml:"metrics"`
+}
+
+// the declaration of a pushed metric
+type pushMetricConfig struct {
+	// counter, gauge or histogram
+	Type   string   `yaml:"type"`
+	Help   string   `yaml:"help"`
+	Labels []string `yaml:"labels"`
+	// upper bounds of the histogram buckets, the prometheus default buckets if omitted
+	Buckets []float64 `yaml:"buckets"`
+	// maximum number of series, further label values are rejected, 0 means unlimited
+	SeriesLimit int `yaml:"series_limit"`
+}
+
+const defaultPushPath = "/push"
+
+// results of kamailio_exporter_push_observations_total
+const (
+	pushAccepted = "accepted"
+	pushRejected = "rejected"
+)
+
+var pushObservations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kamailio_exporter_push_observations_total",
+	Help: "Observations posted to the push endpoint, by result",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(pushObservations)
+}
+
+func checkPushConfig(config *pushConfig) error {
+	if config.Path == "" {
+		config.Path = defaultPushPath
+	}
+	if !strings.HasPrefix(config.Path, "/") || config.Path == "/" || strings.HasPrefix(config.Path, "/-/") {
+		return fmt.Errorf("invalid path %q", config.Path)
+	}
+	for name, metric := range config.Metrics {
+		if err := checkPushMetricConfig(name, metric); err != nil {
+			return fmt.Errorf("metrics: %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func checkPushMetricConfig(name string, config *pushMetricConfig) error {
+	if !metricNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid metric name")
+	}
+	switch config.Type {
+	case "counter", "gauge":
+		if len(config.Buckets) > 0 {
+			return fmt.Errorf("buckets are only allowed for histograms")
+		}
+	case "histogram":
+		for i, bound := range config.Buckets {
+			if i > 0 && bound <= config.Buckets[i-1] {
+				return fmt.Errorf("buckets must be in increasing order")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q, use one of counter, gauge or histogram", config.Type)
+	}
+	labels := make(map[string]bool)
+	for _, label := range config.Labels {
+		if !labelNameRegexp.MatchString(label) || strings.HasPrefix(label, "__") || (config.Type == "histogram" && label == "le") {
+			return fmt.Errorf("invalid label name %q", label)
+		}
+		if labels[label] {
+			return fmt.Errorf("label %s is declared more than once", label)
+		}
+		labels[label] = true
+	}
+	if config.SeriesLimit < 0 {
+		return fmt.Errorf("series_limit must not be negative")
+	}
+	return nil
+}
+
+// a pushed metric and its series
+type pushMetric struct {
+	name   string
+	config *pushMetricConfig
+	// a CounterVec, GaugeVec or HistogramVec
+	vec prometheus.Collector
+
+	mu     sync.Mutex
+	series map[string]bool
+}
+
+var (
+	// all pushed metrics by their source and declaration, a metric keeps its values
+	// over reloads as long as its declaration does not change
+	pushMetricsMu sync.Mutex
+	pushMetrics   = make(map[string]map[string]*pushMetric)
+)
+
+// identifies the declaration of a pushed metric
+func pushDeclaration(name string, config *pushMetricConfig) string {
+	return fmt.Sprintf("%s %s %q %v %v %d", name, config.Type, config.Help, config.Labels, config.Buckets, config.SeriesLimit)
+}
+
+// the pushed metrics of the declarations, by metric name without "kamailio_"
+// the source tells apart metrics with the same declaration fed by different sources, e.g. "push" and "evapi"
+func pushedMetrics(source string, configs map[string]*pushMetricConfig) map[string]*pushMetric {
+	pushMetricsMu.Lock()
+	defer pushMetricsMu.Unlock()
+	declared, ok := pushMetrics[source]
+	if !ok {
+		declared = make(map[string]*pushMetric)
+		pushMetrics[source] = declared
+	}
+	metrics := make(map[string]*pushMetric)
+	for name, config := range configs {
+		declaration := pushDeclaration(name, config)
+		metric, ok := declared[declaration]
+		if !ok {
+			metric = newPushMetric("kamailio_"+name, config)
+			declared[declaration] = metric
+		}
+		metrics[name] = metric
+	}
+	return metrics
+}
+
+// drop the pushed metrics of a source which are not declared anymore,
+// called once a configuration is in effect, so a failed reload keeps the metrics of the running one
+func prunePushedMetrics(source string, configs map[string]*pushMetricConfig) {
+	pushMetricsMu.Lock()
+	defer pushMetricsMu.Unlock()
+	declared := make(map[string]bool)
+	for name, config := range configs {
+		declared[pushDeclaration(name, config)] = true
+	}
+	for declaration := range pushMetrics[source] {
+		if !declared[declaration] {
+			delete(pushMetrics[source], declaration)
+		}
+	}
+}
+
+func newPushMetric(name string, config *pushMetricConfig) *pushMetric {
+	help := config.Help
+	if help == "" {
+		help = "Pushed metric " + strings.TrimPrefix(name, "kamailio_")
+	}
+	metric := &pushMetric{name: name, config: config, series: make(map[string]bool)}
+	switch config.Type {
+	case "counter":
+		metric.vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, config.Labels)
+	case "gauge":
+		metric.vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, config.Labels)
+	case "histogram":
+		metric.vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: config.Buckets}, config.Labels)
+	}
+	return metric
+}
+
+// an observation posted by a script, e.g.
+// {"metric": "calls_total", "labels": {"carrier": "a"}}
+// {"metric": "call_setup_seconds", "labels": {"carrier": "a"}, "value": 0.8}
+type pushObservation struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels"`
+	// increment of a counter (1 if omitted), value of a gauge, observation of a histogram
+	Value *float64 `json:"value"`
+}
+
+// check an observation against the declaration of its metric, and return the label values
+func (m *pushMetric) check(observation *pushObservation) ([]string, error) {
+	if len(observation.Labels) != len(m.config.Labels) {
+		return nil, fmt.Errorf("metric %s expects the labels [%s]", observation.Metric, strings.Join(m.config.Labels, ","))
+	}
+	labelValues := make([]string, len(m.config.Labels))
+	for i, label := range m.config.Labels {
+		value, ok := observation.Labels[label]
+		if !ok {
+			return nil, fmt.Errorf("metric %s expects the labels [%s]", observation.Metric, strings.Join(m.config.Labels, ","))
+		}
+		labelValues[i] = value
+	}
+	if observation.Value == nil {
+		if m.config.Type != "counter" {
+			return nil, fmt.Errorf("the value is missing")
+		}
+	} else if math.IsNaN(*observation.Value) || (m.config.Type == "counter" && *observation.Value < 0) {
+		return nil, fmt.Errorf("invalid value %v", *observation.Value)
+	}
+	return labelValues, nil
+}
+
+// apply an observation, unless it creates a series beyond the series limit
+func (m *pushMetric) apply(observation *pushObservation, labelValues []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	if !m.series[key] {
+		if m.config.SeriesLimit > 0 && len(m.series) >= m.config.SeriesLimit {
+			return fmt.Errorf("metric %s reached its series limit of %d", observation.Metric, m.config.SeriesLimit)
+		}
+		m.series[key] = true
+	}
+	switch vec := m.vec.(type) {
+	case *prometheus.CounterVec:
+		value := 1.0
+		if observation.Value != nil {
+			value = *observation.Value
+		}
+		vec.WithLabelValues(labelValues...).Add(value)
+	case *prometheus.GaugeVec:
+		vec.WithLabelValues(labelValues...).Set(*observation.Value)
+	case *prometheus.HistogramVec:
+		vec.WithLabelValues(labelValues...).Observe(*observation.Value)
+	}
+	return nil
+}
+
+// accepts POST requests with an observation or an array of observations as json
+type pushHandler struct {
+	metrics map[string]*pushMetric
+}
+
+// observations are limited to this size per request
+const maxPushBodySize = 1 << 20
+
+func (h *pushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to push observations", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPushBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read the observations: %s", err), http.StatusBadRequest)
+		return
+	}
+	var observations []*pushObservation
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(body, &observations)
+	} else {
+		observation := &pushObservation{}
+		err = json.Unmarshal(body, observation)
+		observations = append(observations, observation)
+	}
+	if err != nil {
+		pushObservations.WithLabelValues(pushRejected).Inc()
+		http.Error(w, fmt.Sprintf("invalid observations: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// all observations are checked before any of them is applied
+	labelValues := make([][]string, len(observations))
+	for i, observation := range observations {
+		metric, ok := h.metrics[observation.Metric]
+		if !ok {
+			err = fmt.Errorf("metric %q is not declared", observation.Metric)
+		} else {
+			labelValues[i], err = metric.check(observation)
+		}
+		if err != nil {
+			pushObservations.WithLabelValues(pushRejected).Add(float64(len(observations)))
+			log.Debugf("Rejecting pushed observations: observation #%d: %s", i+1, err)
+			http.Error(w, fmt.Sprintf("observation #%d: %s", i+1, err), http.StatusBadRequest)
+			return
+		}
+	}
+	var errors []string
+	for i, observation := range observations {
+		if err := h.metrics[observation.Metric].apply(observation, labelValues[i]); err != nil {
+			pushObservations.WithLabelValues(pushRejected).Inc()
+			errors = append(errors, fmt.Sprintf("observation #%d: %s", i+1, err))
+			continue
+		}
+		pushObservations.WithLabelValues(pushAccepted).Inc()
+	}
+	if len(errors) > 0 {
+		warnLimiter.Warnf(log.WithField("path", r.URL.Path), "push:limit", "Rejecting pushed observations: %s", strings.Join(errors, ", "))
+		http.Error(w, strings.Join(errors, "\n"), http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// a collector producing the pushed metrics of a source
+type pushCollector struct {
+	// who pushes the metrics, e.g. "push endpoint"
+	producer string
+	// sorted by name
+	metrics []*pushMetric
+}
+
+func newPushCollector(config *collectorConfig) (Collector, error) {
+	if config.settings.push == nil {
+		return &pushCollector{}, nil
+	}
+	return newPushedMetricsCollector("push endpoint", pushedMetrics("push", config.settings.push.Metrics), config.mappings)
+}
+
+func newPushedMetricsCollector(producer string, metrics map[string]*pushMetric, mappings []*metricMapping) (*pushCollector, error) {
+	collector := &pushCollector{producer: producer}
+	registryNames := defaultRegistryNames()
+	for _, metric := range metrics {
+		for _, mapping := range mappings {
+			if mapping.name == metric.name {
+				return nil, fmt.Errorf("metric %s collides with a built-in metric", metric.name)
+			}
+		}
+		for _, name := range exporterMetricNames {
+			if name == metric.name {
+				return nil, fmt.Errorf("metric %s collides with a built-in metric", metric.name)
+			}
+		}
+		if isDefaultRegistryMetric(registryNames, metric.name) {
+			return nil, fmt.Errorf("metric %s collides with a metric of the exporter", metric.name)
+		}
+		collector.metrics = append(collector.metrics, metric)
+	}
+	sort.Slice(collector.metrics, func(i, j int) bool { return collector.metrics[i].name < collector.metrics[j].name })
+	return collector, nil
+}
+
+func (c *pushCollector) Update(s *scrape, metricChannel chan<- prometheus.Metric) error {
+	for _, metric := range c.metrics {
+		if producer, ok := s.names[metric.name]; ok {
+			warnLimiter.Warnf(s.log, "push:"+metric.name, "Skipping metric %s of the %s, it is already produced by %s", metric.name, c.producer, producer)
+			continue
+		}
+		s.names[metric.name] = c.producer
+		// the series limits of the declarations apply instead of those of the collectors
+		metric.vec.Collect(metricChannel)
+	}
+	return nil
+}
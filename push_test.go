@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPushedMetricsKeepsDeclaredMetrics(t *testing.T) {
+	calls := &pushMetricConfig{Type: "counter", Labels: []string{"carrier"}}
+	active := &pushMetricConfig{Type: "gauge"}
+	first := pushedMetrics("test", map[string]*pushMetricConfig{"calls_total": calls, "active_calls": active})
+	other := pushedMetrics("other", map[string]*pushMetricConfig{"calls_total": calls})
+	if other["calls_total"] == first["calls_total"] {
+		t.Errorf("sources share a metric")
+	}
+
+	// unchanged declarations keep their metric, changed ones get a new one
+	changed := &pushMetricConfig{Type: "gauge", Help: "Active calls"}
+	second := pushedMetrics("test", map[string]*pushMetricConfig{"calls_total": calls, "active_calls": changed})
+	if second["calls_total"] != first["calls_total"] || second["active_calls"] == first["active_calls"] {
+		t.Errorf("got %v after a reload of %v", second, first)
+	}
+	// the metrics of a configuration which is not applied are kept until the next one is
+	if again := pushedMetrics("test", map[string]*pushMetricConfig{"active_calls": active}); again["active_calls"] != first["active_calls"] {
+		t.Errorf("lost the metric of the running configuration")
+	}
+	prunePushedMetrics("test", map[string]*pushMetricConfig{"calls_total": calls})
+	if len(pushMetrics["test"]) != 1 || len(pushMetrics["other"]) != 1 {
+		t.Errorf("got %d and %d metrics, want the declared ones only", len(pushMetrics["test"]), len(pushMetrics["other"]))
+	}
+	third := pushedMetrics("test", map[string]*pushMetricConfig{"calls_total": calls, "active_calls": changed})
+	if third["calls_total"] != first["calls_total"] || third["active_calls"] == second["active_calls"] {
+		t.Errorf("a dropped declaration kept its metric")
+	}
+}
+
+func TestPushHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+		// the values of calls_total by carrier afterwards
+		calls map[string]float64
+	}{
+		{"not a post", http.MethodGet, "", http.StatusMethodNotAllowed, map[string]float64{}},
+		{"invalid json", http.MethodPost, `{"metric":`, http.StatusBadRequest, map[string]float64{}},
+		{"single observation", http.MethodPost, `{"metric": "calls_total", "labels": {"carrier": "a"}}`, http.StatusNoContent, map[string]float64{"a": 1}},
+		{
+			"batch",
+			http.MethodPost,
+			`[{"metric": "calls_total", "labels": {"carrier": "a"}, "value": 2}, {"metric": "calls_total", "labels": {"carrier": "b"}}]`,
+			http.StatusNoContent,
+			map[string]float64{"a": 2, "b": 1},
+		},
+		{
+			"a batch with an invalid observation is rejected as a whole",
+			http.MethodPost,
+			`[{"metric": "calls_total", "labels": {"carrier": "a"}}, {"metric": "unknown"}]`,
+			http.StatusBadRequest,
+			map[string]float64{},
+		},
+		{
+			"a batch with a wrong label is rejected as a whole",
+			http.MethodPost,
+			`[{"metric": "calls_total", "labels": {"carrier": "a"}}, {"metric": "calls_total", "labels": {"dir": "in"}}]`,
+			http.StatusBadRequest,
+			map[string]float64{},
+		},
+		{
+			"observations beyond the series limit are rejected",
+			http.MethodPost,
+			`[{"metric": "calls_total", "labels": {"carrier": "a"}}, {"metric": "calls_total", "labels": {"carrier": "b"}}, {"metric": "calls_total", "labels": {"carrier": "c"}}, {"metric": "calls_total", "labels": {"carrier": "a"}}]`,
+			http.StatusTooManyRequests,
+			map[string]float64{"a": 2, "b": 1},
+		},
+		{
+			"too large",
+			http.MethodPost,
+			`[` + strings.Repeat(`{"metric": "calls_total", "labels": {"carrier": "a"}},`, maxPushBodySize/50) + `{"metric": "calls_total", "labels": {"carrier": "a"}}]`,
+			http.StatusBadRequest,
+			map[string]float64{},
+		},
+	}
+	for _, test := range tests {
+		metric := newPushMetric("kamailio_calls_total", &pushMetricConfig{Type: "counter", Labels: []string{"carrier"}, SeriesLimit: 2})
+		handler := &pushHandler{metrics: map[string]*pushMetric{"calls_total": metric}}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(test.method, "/push", strings.NewReader(test.body)))
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+		calls := make(map[string]float64)
+		for key := range metric.series {
+			calls[key] = testutil.ToFloat64(metric.vec.(*prometheus.CounterVec).WithLabelValues(key))
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%s: got calls %v, want %v", test.name, calls, test.calls)
+		}
+	}
+}
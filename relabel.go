@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// relabel actions, same semantics as in prometheus' metric_relabel_configs
+const (
+	relabelReplace  = "replace"
+	relabelKeep     = "keep"
+	relabelDrop     = "drop"
+	relabelLabelMap = "labelmap"
+)
+
+// the label holding the metric name during relabeling
+const metricNameLabel = "__name__"
+
+// a relabel rule as declared in the config file
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+// a validated relabel rule
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// validate a relabel rule and fill in the defaults
+func newRelabelRule(config *relabelConfig) (*relabelRule, error) {
+	rule := &relabelRule{
+		sourceLabels: config.SourceLabels,
+		separator:    ";",
+		targetLabel:  config.TargetLabel,
+		replacement:  "$1",
+		action:       config.Action,
+	}
+	if config.Separator != nil {
+		rule.separator = *config.Separator
+	}
+	if config.Replacement != nil {
+		rule.replacement = *config.Replacement
+	}
+	if rule.action == "" {
+		rule.action = relabelReplace
+	}
+	regex := "(.*)"
+	if config.Regex != nil {
+		regex = *config.Regex
+	}
+	var err error
+	if rule.regex, err = regexp.Compile("^(?:" + regex + ")$"); err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %s", regex, err)
+	}
+
+	switch rule.action {
+	case relabelReplace:
+		if rule.targetLabel == "" {
+			return nil, fmt.Errorf("target_label is missing for action %s", rule.action)
+		}
+	case relabelKeep, relabelDrop, relabelLabelMap:
+	default:
+		return nil, fmt.Errorf("unknown action %q, use one of replace, keep, drop or labelmap", rule.action)
+	}
+	return rule, nil
+}
+
+// apply the rules in order to a label set, which includes the metric name as "__name__"
+// the result is nil if the metric is dropped
+func relabel(labels map[string]string, rules []*relabelRule) map[string]string {
+	for _, rule := range rules {
+		values := make([]string, len(rule.sourceLabels))
+		for i, name := range rule.sourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case relabelKeep:
+			if !rule.regex.MatchString(value) {
+				return nil
+			}
+		case relabelDrop:
+			if rule.regex.MatchString(value) {
+				return nil
+			}
+		case relabelReplace:
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.targetLabel, value, match))
+			if target != metricNameLabel && !labelNameRegexp.MatchString(target) {
+				continue
+			}
+			replacement := string(rule.regex.ExpandString(nil, rule.replacement, value, match))
+			if replacement == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = replacement
+			}
+		case relabelLabelMap:
+			mapped := make(map[string]string)
+			for name, labelValue := range labels {
+				if match := rule.regex.FindStringSubmatchIndex(name); match != nil {
+					mapped[string(rule.regex.ExpandString(nil, rule.replacement, name, match))] = labelValue
+				}
+			}
+			for name, labelValue := range mapped {
+				labels[name] = labelValue
+			}
+		}
+	}
+	return labels
+}
+
+// a prometheus.Gatherer applying relabel rules to the metrics of another gatherer
+type relabelGatherer struct {
+	gatherer prometheus.Gatherer
+	rules    []*relabelRule
+}
+
+// part of the prometheus.Gatherer interface
+func (g *relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if len(g.rules) == 0 {
+		return families, err
+	}
+
+	relabeled := make(map[string]*dto.MetricFamily)
+	seen := make(map[string]bool)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			labels := map[string]string{metricNameLabel: family.GetName()}
+			for _, pair := range metric.Label {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if labels = relabel(labels, g.rules); labels == nil {
+				continue
+			}
+
+			name := labels[metricNameLabel]
+			delete(labels, metricNameLabel)
+			if !metricNameRegexp.MatchString(name) {
+				warnLimiter.Warnf(log.WithField("metric", family.GetName()), "relabel:"+name,
+					"Dropping metric, relabeling produced the invalid name %q", name)
+				continue
+			}
+			target, ok := relabeled[name]
+			if !ok {
+				target = &dto.MetricFamily{Name: proto.String(name), Help: family.Help, Type: family.Type}
+				relabeled[name] = target
+			} else if target.GetType() != family.GetType() {
+				warnLimiter.Warnf(log.WithField("metric", family.GetName()), "relabel:"+name,
+					"Dropping metric, relabeling merged it into %s of a different type", name)
+				continue
+			}
+
+			// prometheus rejects the same series twice
+			key := seriesKey(name, labels)
+			if seen[key] {
+				warnLimiter.Warnf(log.WithField("metric", family.GetName()), "relabel:"+key,
+					"Dropping metric, relabeling produced the duplicate series %s", key)
+				continue
+			}
+			seen[key] = true
+
+			metric.Label = labelPairs(labels)
+			target.Metric = append(target.Metric, metric)
+		}
+	}
+
+	result := make([]*dto.MetricFamily, 0, len(relabeled))
+	for _, family := range relabeled {
+		result = append(result, family)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GetName() < result[j].GetName() })
+	return result, err
+}
+
+// a label map as sorted label pairs
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	return pairs
+}
+
+// a string identifying a series, e.g. kamailio_sl_reply_total{code="200"}
+func seriesKey(name string, labels map[string]string) string {
+	var parts []string
+	for _, pair := range labelPairs(labels) {
+		parts = append(parts, fmt.Sprintf("%s=%q", pair.GetName(), pair.GetValue()))
+	}
+	return name + "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func mustRelabelRule(t *testing.T, config relabelConfig) *relabelRule {
+	t.Helper()
+	rule, err := newRelabelRule(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+// the expected results follow prometheus' metric_relabel_configs
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		config relabelConfig
+		labels map[string]string
+		result map[string]string
+	}{
+		{
+			"replace with defaults copies the joined source labels",
+			relabelConfig{SourceLabels: []string{"a", "b"}, TargetLabel: "c"},
+			map[string]string{"a": "1", "b": "2"},
+			map[string]string{"a": "1", "b": "2", "c": "1;2"},
+		},
+		{
+			"missing source labels are empty",
+			relabelConfig{SourceLabels: []string{"a", "missing"}, Separator: proto.String("-"), TargetLabel: "c"},
+			map[string]string{"a": "1"},
+			map[string]string{"a": "1", "c": "1-"},
+		},
+		{
+			"the regex is anchored",
+			relabelConfig{SourceLabels: []string{"a"}, Regex: proto.String("foo"), TargetLabel: "c", Replacement: proto.String("x")},
+			map[string]string{"a": "foobar"},
+			map[string]string{"a": "foobar"},
+		},
+		{
+			"groups expand in the replacement and the target",
+			relabelConfig{SourceLabels: []string{"a"}, Regex: proto.String("(.+)-(.+)"), TargetLabel: "l_$1", Replacement: proto.String("$2")},
+			map[string]string{"a": "x-y"},
+			map[string]string{"a": "x-y", "l_x": "y"},
+		},
+		{
+			"an empty replacement deletes the target",
+			relabelConfig{SourceLabels: []string{"a"}, TargetLabel: "b", Replacement: proto.String("")},
+			map[string]string{"a": "1", "b": "2"},
+			map[string]string{"a": "1"},
+		},
+		{
+			"an invalid target is skipped",
+			relabelConfig{SourceLabels: []string{"a"}, Regex: proto.String("(.*)"), TargetLabel: "${1}", Replacement: proto.String("x")},
+			map[string]string{"a": "1x"},
+			map[string]string{"a": "1x"},
+		},
+		{
+			"the metric name can be replaced",
+			relabelConfig{SourceLabels: []string{metricNameLabel}, Regex: proto.String("kamailio_(.*)"), TargetLabel: metricNameLabel, Replacement: proto.String("sip_$1")},
+			map[string]string{metricNameLabel: "kamailio_core_requests_total"},
+			map[string]string{metricNameLabel: "sip_core_requests_total"},
+		},
+		{
+			"replace without source labels sets a static label",
+			relabelConfig{TargetLabel: "site", Replacement: proto.String("fra")},
+			map[string]string{"code": "200"},
+			map[string]string{"code": "200", "site": "fra"},
+		},
+		{
+			"keep a matching series",
+			relabelConfig{SourceLabels: []string{"code"}, Regex: proto.String("[45]xx"), Action: relabelKeep},
+			map[string]string{"code": "4xx"},
+			map[string]string{"code": "4xx"},
+		},
+		{
+			"keep drops other series",
+			relabelConfig{SourceLabels: []string{"code"}, Regex: proto.String("[45]xx"), Action: relabelKeep},
+			map[string]string{"code": "200"},
+			nil,
+		},
+		{
+			"keep without source labels matches the empty value",
+			relabelConfig{Action: relabelKeep},
+			map[string]string{"code": "200"},
+			map[string]string{"code": "200"},
+		},
+		{
+			"keep without source labels drops every series if the regex needs a value",
+			relabelConfig{Regex: proto.String(".+"), Action: relabelKeep},
+			map[string]string{"code": "200"},
+			nil,
+		},
+		{
+			"drop a matching series",
+			relabelConfig{SourceLabels: []string{metricNameLabel}, Regex: proto.String("go_.*"), Action: relabelDrop},
+			map[string]string{metricNameLabel: "go_goroutines"},
+			nil,
+		},
+		{
+			"labelmap copies the matching labels",
+			relabelConfig{Regex: proto.String("carrier_(.+)"), Replacement: proto.String("$1"), Action: relabelLabelMap},
+			map[string]string{"carrier_name": "a", "code": "200"},
+			map[string]string{"carrier_name": "a", "name": "a", "code": "200"},
+		},
+	}
+	for _, test := range tests {
+		result := relabel(test.labels, []*relabelRule{mustRelabelRule(t, test.config)})
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: got %v, want %v", test.name, result, test.result)
+		}
+	}
+}
+
+func TestNewRelabelRuleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config relabelConfig
+	}{
+		{"replace without target", relabelConfig{SourceLabels: []string{"a"}}},
+		{"invalid regex", relabelConfig{SourceLabels: []string{"a"}, TargetLabel: "b", Regex: proto.String("(")}},
+		{"unknown action", relabelConfig{SourceLabels: []string{"a"}, Action: "hashmod"}},
+	}
+	for _, test := range tests {
+		if _, err := newRelabelRule(&test.config); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestRelabelGathererDropsDuplicates(t *testing.T) {
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{{
+			Name: proto.String("kamailio_sl_replies_total"),
+			Help: proto.String("Stateless replies"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Label: labelPairs(map[string]string{"code": "200"}), Counter: &dto.Counter{Value: proto.Float64(1)}},
+				{Label: labelPairs(map[string]string{"code": "202"}), Counter: &dto.Counter{Value: proto.Float64(2)}},
+				{Label: labelPairs(map[string]string{"code": "404"}), Counter: &dto.Counter{Value: proto.Float64(3)}},
+			},
+		}}, nil
+	})
+	// folds the codes into classes, 200 and 202 collide
+	rule := mustRelabelRule(t, relabelConfig{SourceLabels: []string{"code"}, Regex: proto.String(`(\d)\d\d`), TargetLabel: "code", Replacement: proto.String("${1}xx")})
+	families, err := (&relabelGatherer{gatherer: gatherer, rules: []*relabelRule{rule}}).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("unexpected result %v", families)
+	}
+	for i, expected := range []struct {
+		code  string
+		value float64
+	}{{"2xx", 1}, {"4xx", 3}} {
+		metric := families[0].Metric[i]
+		if metric.Label[0].GetValue() != expected.code || metric.Counter.GetValue() != expected.value {
+			t.Errorf("series #%d: got %v, want code %s value %v", i+1, metric, expected.code, expected.value)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kamailio_exporter_config_last_reload_success",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kamailio_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configLastReloadSuccess, configLastReloadSuccessTimestamp)
+}
+
+// serves the metrics with the current configuration,
+// which is replaced as a whole on every successful reload
+type reloader struct {
+	cliContext *cli.Context
+	// serializes reloads
+	reloadMu sync.Mutex
+
+	mu  sync.RWMutex
+	mux *http.ServeMux
+}
+
+// load the initial configuration, it must be valid
+func newReloader(cliContext *cli.Context) (*reloader, error) {
+	r := &reloader{cliContext: cliContext}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load the config file and the mappings again and swap them in,
+// the current configuration is kept if anything is invalid
+func (r *reloader) reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	config, err := loadConfiguration(r.cliContext)
+	if err == nil {
+		err = config.apply()
+	}
+	if err != nil {
+		configLastReloadSuccess.Set(0)
+		return err
+	}
+	r.mu.Lock()
+	r.mux = config.mux
+	r.mu.Unlock()
+	configLastReloadSuccess.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	mux := r.mux
+	r.mu.RUnlock()
+	mux.ServeHTTP(w, req)
+}
+
+// reload on SIGHUP
+func (r *reloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Reloading the configuration, received SIGHUP")
+			if err := r.reload(); err != nil {
+				log.Errorf("Could not reload the configuration, keeping the current one: %s", err)
+			}
+		}
+	}()
+}
+
+// reload on POST /-/reload
+func (r *reloader) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to reload the configuration", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Info("Reloading the configuration, requested via http")
+	if err := r.reload(); err != nil {
+		log.Errorf("Could not reload the configuration, keeping the current one: %s", err)
+		http.Error(w, fmt.Sprintf("could not reload the configuration: %s", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "configuration reloaded")
+}
+
+// a validated configuration, not in effect yet
+type configuration struct {
+	mux *http.ServeMux
+	// nil if not configured or the collector is disabled
+	push   *pushConfig
+	statsd *statsdConfig
+	evapi  *evapiConfig
+}
+
+// create the collectors and http handlers of the current configuration,
+// without touching the statsd listener or the evapi connection of the running one
+func loadConfiguration(c *cli.Context) (*configuration, error) {
+	settings, err := loadConfig(c.String("configFile"))
+	if err != nil {
+		return nil, err
+	}
+	if len(settings.relabelRules) > 0 {
+		log.Infof("Applying %d metric relabel rules", len(settings.relabelRules))
+	}
+
+	// create a collector
+	collector, err := NewStatsCollector(c, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	constLabels, err := parseConstLabels(c.StringSlice("label"), os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConstLabelClashes(constLabels, collector.labelNames(settings)); err != nil {
+		return nil, err
+	}
+
+	config := &configuration{}
+	mux := http.NewServeMux()
+	metricsPath := c.String("metricsPath")
+	// wire "/" to return some helpful info
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+             <head><title>Kamailio Exporter</title></head>
+             <body>
+			 <p>This is a prometheus metric exporter for Kamailio.</p>
+			 <p>Browse <a href='` + metricsPath + `'>` + metricsPath + `</a>
+			 to get the metrics.</p>
+             </body>
+             </html>`))
+	})
+	// wire "/metrics" -> the collectors, registered for each request
+	mux.Handle(metricsPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		&metricsHandler{collector: collector, constLabels: constLabels, relabelRules: settings.relabelRules}))
+	// wire the extra endpoints of the config file -> some of the collectors
+	for _, endpoint := range settings.endpoints {
+		if endpoint.Path == metricsPath {
+			return nil, fmt.Errorf("endpoint %s is already used by --metricsPath", endpoint.Path)
+		}
+		handler, err := newEndpointHandler(collector, constLabels, settings.relabelRules, endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %s", endpoint.Path, err)
+		}
+		mux.Handle(endpoint.Path, handler)
+		log.Infof("Serving collectors %v on %s", endpoint.Collectors, endpoint.Path)
+	}
+	// wire the push endpoint of the config file -> the push collector
+	if push := settings.push; push != nil && collector.enabled["push"] {
+		if push.Path == metricsPath {
+			return nil, fmt.Errorf("push endpoint %s is already used by --metricsPath", push.Path)
+		}
+		mux.Handle(push.Path, &pushHandler{metrics: pushedMetrics("push", push.Metrics)})
+		log.Infof("Accepting %d pushed metrics on %s", len(push.Metrics), push.Path)
+		config.push = push
+	}
+	if collector.enabled["statsd"] {
+		config.statsd = settings.statsd
+	}
+	if collector.enabled["evapi"] {
+		config.evapi = settings.evapi
+	}
+	config.mux = mux
+	return config, nil
+}
+
+// put the parts of the configuration into effect which run in the background,
+// the running ones are kept if the statsd listener can't be started
+func (config *configuration) apply() error {
+	// listen for statsd packets -> the statsd collector
+	if err := configureStatsd(config.statsd); err != nil {
+		return err
+	}
+	// connect to evapi -> the evapi collector, nothing can fail from here on
+	// the connection is kept if its configuration did not change
+	configureEvapi(config.evapi)
+	// forget the pushed metrics of removed declarations
+	var pushMetrics, evapiMetrics map[string]*pushMetricConfig
+	if config.push != nil {
+		pushMetrics = config.push.Metrics
+	}
+	if config.evapi != nil {
+		evapiMetrics = config.evapi.Metrics
+	}
+	prunePushedMetrics("push", pushMetrics)
+	prunePushedMetrics("evapi", evapiMetrics)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// a cli context with the defaults of all flags and the given arguments
+func newTestContext(t *testing.T, args ...string) *cli.Context {
+	t.Helper()
+	set := flag.NewFlagSet("kamailio_exporter", flag.ContinueOnError)
+	for _, f := range appFlags() {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestFailedReloadKeepsConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer configureEvapi(nil)
+	defer configureStatsd(nil)
+	configFile := filepath.Join(dir, "config.yml")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`
+statsd: {listen_address: "127.0.0.1:0", series_limit: 5}
+evapi: {address: "127.0.0.1:1", reconnect_interval: 1h}
+`)
+	r, err := newReloader(newTestContext(t, "--configFile", configFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := r.mux
+
+	// the endpoint clashes with --metricsPath, which is checked after the statsd and evapi settings are known
+	writeConfig(`
+statsd: {listen_address: "127.0.0.1:0", series_limit: 6}
+evapi: {address: "127.0.0.1:2", reconnect_interval: 1h}
+endpoints: [{path: /metrics, collectors: [core]}]
+`)
+	if err := r.reload(); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if r.mux != mux || testutil.ToFloat64(configLastReloadSuccess) != 0 {
+		t.Errorf("the failed reload replaced the handlers")
+	}
+	if limit := runningStatsdStore().config.SeriesLimit; limit != 5 {
+		t.Errorf("the statsd listener runs with series limit %d of the failed reload", limit)
+	}
+	if address := evapiRunning.config.Address; address != "127.0.0.1:1" {
+		t.Errorf("the evapi consumer connects to %s of the failed reload", address)
+	}
+
+	writeConfig(`
+statsd: {listen_address: "127.0.0.1:0", series_limit: 6}
+evapi: {address: "127.0.0.1:2", reconnect_interval: 1h}
+`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.mux == mux || runningStatsdStore().config.SeriesLimit != 6 || evapiRunning.config.Address != "127.0.0.1:2" {
+		t.Errorf("the reload did not apply the configuration")
+	}
+}
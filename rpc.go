@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/florentchauveau/go-kamailio-binrpc/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// a binrpc connection to kamailio, shared by all collectors of a scrape
+// the connection is established with the first call
+type rpcSession struct {
+	dial func(*log.Entry) (net.Conn, error)
+	log  *log.Entry
+	conn net.Conn
+}
+
+// send a rpc request and return its cookie, the connection is established on first use
+func (r *rpcSession) send(method string, args []interface{}) ([]byte, error) {
+	if r.conn == nil {
+		conn, err := r.dial(r.log)
+		if err != nil {
+			return nil, err
+		}
+		r.conn = conn
+	}
+	r.log.Debugf("Calling %s %v", method, args)
+	// TODO
+	// c.conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	// WritePacket returns the cookie generated
+	cookie, err := binrpc.WritePacket(r.conn, append([]interface{}{method}, args...)...)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	return cookie, nil
+}
+
+// perform a rpc call and return the records of the response
+func (r *rpcSession) call(method string, args ...interface{}) ([]binrpc.Record, error) {
+	cookie, err := r.send(method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cookie is passed again for verification
+	// we receive records in response
+	records, err := binrpc.ReadPacket(r.conn, cookie)
+	if err != nil {
+		// the connection is in an unknown state, don't reuse it
+		r.close()
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty response to %s", method)
+	}
+	return records, nil
+}
+
+// perform a rpc call and return the decoded values of the response,
+// unlike call this supports responses containing arrays and doubles
+func (r *rpcSession) callValues(method string, args ...interface{}) ([]interface{}, error) {
+	cookie, err := r.send(method, args)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(r.conn)
+	header, err := binrpc.ReadHeader(reader)
+	if err == nil && !bytes.Equal(header.Cookie, cookie) {
+		err = fmt.Errorf("expected cookie did not match")
+	}
+	var payload []byte
+	if err == nil {
+		payload = make([]byte, header.PayloadLength)
+		_, err = io.ReadFull(reader, payload)
+	}
+	if err != nil {
+		// the connection is in an unknown state, don't reuse it
+		r.close()
+		return nil, err
+	}
+	values, err := decodeRPCValues(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response to %s: %s", method, err)
+	}
+	// failed calls are answered with an error code and a message
+	if len(values) == 2 {
+		code, isInt := values[0].(int)
+		message, isString := values[1].(string)
+		if isInt && isString {
+			return nil, fmt.Errorf("%s failed with %d %s", method, code, message)
+		}
+	}
+	return values, nil
+}
+
+// close the connection, if any
+func (r *rpcSession) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// a member of a decoded binrpc struct, structs may contain the same name more than once
+type rpcMember struct {
+	name  string
+	value interface{}
+}
+
+// the end of a struct or array
+var errRPCEnd = fmt.Errorf("end of struct or array")
+
+// decode the payload of a binrpc response into
+// int, float64, string, []rpcMember (struct) and []interface{} (array) values
+func decodeRPCValues(payload []byte) ([]interface{}, error) {
+	d := &rpcDecoder{buf: payload}
+	var values []interface{}
+	for len(d.buf) > 0 {
+		value, err := d.value()
+		if err == errRPCEnd {
+			return nil, fmt.Errorf("unexpected end of struct or array")
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+type rpcDecoder struct {
+	buf []byte
+}
+
+func (d *rpcDecoder) next(size int) ([]byte, error) {
+	if size > len(d.buf) {
+		return nil, fmt.Errorf("truncated value, expected %d bytes, got %d", size, len(d.buf))
+	}
+	data := d.buf[:size]
+	d.buf = d.buf[size:]
+	return data, nil
+}
+
+// decode the next value, see the binrpc record format in kamailio's modules/ctl/binrpc.h
+func (d *rpcDecoder) value() (interface{}, error) {
+	header, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	longSize := header[0]&0x80 != 0
+	size := int(header[0] >> 4 & 0x7)
+	valueType := header[0] & 0x0F
+
+	if longSize && size == 0 && (valueType == binrpc.TypeStruct || valueType == binrpc.TypeArray) {
+		return nil, errRPCEnd
+	}
+	if longSize {
+		sizeBytes, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		size = 0
+		for _, b := range sizeBytes {
+			size = size<<8 + int(b)
+		}
+	}
+
+	switch valueType {
+	case binrpc.TypeStruct:
+		var members []rpcMember
+		for {
+			name, err := d.value()
+			if err == errRPCEnd {
+				return members, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			nameString, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("struct member without a name")
+			}
+			value, err := d.value()
+			if err != nil {
+				if err == errRPCEnd {
+					err = fmt.Errorf("struct member %s without a value", nameString)
+				}
+				return nil, err
+			}
+			members = append(members, rpcMember{nameString, value})
+		}
+	case binrpc.TypeArray:
+		values := []interface{}{}
+		for {
+			value, err := d.value()
+			if err == errRPCEnd {
+				return values, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+	}
+
+	data, err := d.next(size)
+	if err != nil {
+		return nil, err
+	}
+	switch valueType {
+	case binrpc.TypeInt, binrpc.TypeDouble:
+		// ints are sent with as few bytes as possible, negative ones with all 4 bytes
+		var n uint32
+		for _, b := range data {
+			n = n<<8 | uint32(b)
+		}
+		if valueType == binrpc.TypeDouble {
+			// doubles are sent as int of the value * 1000
+			return float64(int32(n)) / 1000, nil
+		}
+		return int(int32(n)), nil
+	case binrpc.TypeString, binrpc.TypeAVP:
+		// without the terminating null byte
+		return string(bytes.TrimSuffix(data, []byte{0})), nil
+	case binrpc.TypeBytes:
+		return string(data), nil
+	}
+	return nil, fmt.Errorf("unknown value type %d", valueType)
+}
+
+// the value of the first struct member with this name
+func rpcMemberValue(members []rpcMember, name string) (interface{}, bool) {
+	for _, member := range members {
+		if member.name == name {
+			return member.value, true
+		}
+	}
+	return nil, false
+}
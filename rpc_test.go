@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/florentchauveau/go-kamailio-binrpc/v2"
+)
+
+// encode a binrpc record with a value of at most 7 bytes
+func rpcRecord(valueType byte, data ...byte) []byte {
+	return append([]byte{byte(len(data))<<4 | valueType}, data...)
+}
+
+func rpcString(valueType byte, value string) []byte {
+	data := append([]byte(value), 0)
+	if len(data) <= 7 {
+		return rpcRecord(valueType, data...)
+	}
+	// the size follows the header in a byte of its own
+	return append([]byte{0x80 | 1<<4 | valueType, byte(len(data))}, data...)
+}
+
+func rpcEnd(valueType byte) []byte {
+	return []byte{0x80 | valueType}
+}
+
+func concat(records ...[]byte) []byte {
+	var payload []byte
+	for _, record := range records {
+		payload = append(payload, record...)
+	}
+	return payload
+}
+
+func TestDecodeRPCValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		values  []interface{}
+	}{
+		{"zero", rpcRecord(binrpc.TypeInt), []interface{}{0}},
+		{"int", rpcRecord(binrpc.TypeInt, 0x01, 0x00), []interface{}{256}},
+		{"negative int", rpcRecord(binrpc.TypeInt, 0xFF, 0xFF, 0xFF, 0xFE), []interface{}{-2}},
+		{"double", rpcRecord(binrpc.TypeDouble, 0x05, 0xDC), []interface{}{1.5}},
+		{"string", rpcString(binrpc.TypeString, "abc"), []interface{}{"abc"}},
+		{"long string", rpcString(binrpc.TypeString, "location-contacts"), []interface{}{"location-contacts"}},
+		{"bytes", rpcRecord(binrpc.TypeBytes, 'a', 0, 'b'), []interface{}{"a\x00b"}},
+		{"several values", concat(rpcRecord(binrpc.TypeInt, 7), rpcString(binrpc.TypeString, "x")), []interface{}{7, "x"}},
+		{"empty array", concat(rpcRecord(binrpc.TypeArray), rpcEnd(binrpc.TypeArray)), []interface{}{[]interface{}{}}},
+		{
+			// the response of htable.dump
+			"nested",
+			concat(
+				rpcRecord(binrpc.TypeStruct),
+				rpcString(binrpc.TypeAVP, "entry"), rpcRecord(binrpc.TypeInt, 3),
+				rpcString(binrpc.TypeAVP, "slot"), rpcRecord(binrpc.TypeArray),
+				rpcRecord(binrpc.TypeStruct),
+				rpcString(binrpc.TypeAVP, "name"), rpcString(binrpc.TypeString, "gw1::calls"),
+				rpcString(binrpc.TypeAVP, "value"), rpcRecord(binrpc.TypeInt, 42),
+				rpcEnd(binrpc.TypeStruct),
+				rpcEnd(binrpc.TypeArray),
+				rpcEnd(binrpc.TypeStruct),
+			),
+			[]interface{}{[]rpcMember{
+				{"entry", 3},
+				{"slot", []interface{}{[]rpcMember{{"name", "gw1::calls"}, {"value", 42}}}},
+			}},
+		},
+	}
+	for _, test := range tests {
+		values, err := decodeRPCValues(test.payload)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) {
+			t.Errorf("%s: got %#v, want %#v", test.name, values, test.values)
+		}
+	}
+}
+
+func TestDecodeRPCValuesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		err     string
+	}{
+		{"truncated int", []byte{0x20 | binrpc.TypeInt, 0x01}, "truncated value"},
+		{"truncated size", []byte{0x80 | 2<<4 | binrpc.TypeString, 0x01}, "truncated value"},
+		{"unterminated struct", rpcRecord(binrpc.TypeStruct), "truncated value"},
+		{"stray end", rpcEnd(binrpc.TypeArray), "unexpected end"},
+		{"member without name", concat(rpcRecord(binrpc.TypeStruct), rpcRecord(binrpc.TypeInt, 1)), "without a name"},
+		{"member without value", concat(rpcRecord(binrpc.TypeStruct), rpcString(binrpc.TypeAVP, "a"), rpcEnd(binrpc.TypeStruct)), "without a value"},
+		{"unknown type", rpcRecord(0x0E), "unknown value type"},
+	}
+	for _, test := range tests {
+		if _, err := decodeRPCValues(test.payload); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestRPCMemberValue(t *testing.T) {
+	members := []rpcMember{{"name", "a"}, {"value", 1}, {"name", "b"}}
+	if value, ok := rpcMemberValue(members, "name"); !ok || value != "a" {
+		t.Errorf("got %v %v, want the first member", value, ok)
+	}
+	if _, ok := rpcMemberValue(members, "type"); ok {
+		t.Errorf("found a missing member")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// create a random id which is attached to every log line of a single scrape
+func newScrapeID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// state of a single Collect run
+type scrape struct {
+	id  string
+	log *log.Entry
+	// stats which were expected but not returned by kamailio,
+	// they are logged once at the end of the scrape
+	skipped []string
+	// stats which were already turned into metrics
+	exported map[string]bool
+	// names of generated metric families, with a description of who produced them
+	names map[string]string
+	// the connection to kamailio, shared by all collectors
+	rpc *rpcSession
+	// result of "stats.fetch all", fetched on first use
+	stats      map[string]string
+	statsError error
+	// enforces the series limits
+	guard *seriesGuard
+}
+
+func newScrape(dial func(*log.Entry) (net.Conn, error), limits *seriesLimits) *scrape {
+	id := newScrapeID()
+	logger := log.WithField("scrape_id", id)
+	return &scrape{
+		id:       id,
+		log:      logger,
+		exported: make(map[string]bool),
+		names:    make(map[string]string),
+		rpc:      &rpcSession{dial: dial, log: logger},
+		guard:    newSeriesGuard(limits),
+	}
+}
+
+// the following metrics are produced by this collector
+func (s *scrape) startCollector(name string) {
+	s.guard.collector = name
+}
+
+// the collector is done, produce the series folded by the series limits
+func (s *scrape) finishCollector(metricChannel chan<- prometheus.Metric) {
+	name := s.guard.collector
+	if err := s.guard.flush(metricChannel); err != nil {
+		warnLimiter.Warnf(s.log.WithField("collector", name), "fold:"+name, "Could not fold series: %s", err)
+	}
+	if limited := s.guard.limited[name]; limited > 0 {
+		action := "dropped"
+		if s.guard.limits.action == seriesLimitFold {
+			action = "folded into \"" + otherLabelValue + "\" or dropped"
+		}
+		warnLimiter.Warnf(s.log.WithField("collector", name), "limit:"+name,
+			"Collector %s exceeded a series limit, %d series were %s", name, limited, action)
+	}
+}
+
+// produce a metric, unless it exceeds a series limit
+func (s *scrape) sendMetric(metricChannel chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, value float64, labelValues ...string) error {
+	if !s.guard.admit() {
+		s.guard.limit(desc, valueType, value, labelValues)
+		return nil
+	}
+	if s.guard.holdOther(desc, valueType, value, labelValues) {
+		return nil
+	}
+	metric, err := prometheus.NewConstMetric(desc, valueType, value, labelValues...)
+	if err != nil {
+		return err
+	}
+	metricChannel <- metric
+	return nil
+}
+
+// produce a histogram, unless it exceeds a series limit
+// histograms are never folded, they are dropped instead
+func (s *scrape) sendHistogram(metricChannel chan<- prometheus.Metric, desc *prometheus.Desc, count uint64, sum float64, buckets map[float64]uint64, labelValues ...string) error {
+	if !s.guard.admit() {
+		s.guard.limited[s.guard.collector]++
+		return nil
+	}
+	metric, err := prometheus.NewConstHistogram(desc, count, sum, buckets, labelValues...)
+	if err != nil {
+		return err
+	}
+	metricChannel <- metric
+	return nil
+}
+
+// all kamailio stats as a flat key=>value map
+// they are fetched once per scrape, no matter how many collectors need them
+func (s *scrape) statMap() (map[string]string, error) {
+	if s.stats == nil && s.statsError == nil {
+		s.stats, s.statsError = fetchStats(s.rpc)
+		if s.statsError != nil {
+			warnLimiter.Errorf(s.log, "fetch", "Could not fetch values from kamailio: %s", s.statsError)
+		}
+	}
+	return s.stats, s.statsError
+}
+
+// release everything held by the scrape
+func (s *scrape) close() {
+	s.rpc.close()
+	s.flushSkipped()
+}
+
+// log a summary of all skipped stat values
+func (s *scrape) flushSkipped() {
+	if len(s.skipped) == 0 {
+		return
+	}
+	s.log.WithField("stats", strings.Join(s.skipped, ",")).
+		Debugf("Skipped %d stat values, they were not returned by kamailio", len(s.skipped))
+	s.skipped = nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// a collector producing the user-defined "script." stats and those of the configured stat groups
+// These values are user-defined and populated within the kamailio script.
+// See https://www.kamailio.org/docs/modules/5.2.x/modules/statistics.html
+type scriptedCollector struct {
+	// the stat groups exported as scripted metrics, by group name
+	groups map[string]*scriptedGroupConfig
+	// stats of the groups covered by the mappings are left to their collectors
+	mappings []*metricMapping
+	// separates the metric name and the label names and values within a stat name,
+	// e.g. "calls_total__carrier__a", empty if stat names carry no labels
+	labelSeparator string
+	// declared metrics of the config file, by lower-cased metric name without "kamailio_"
+	metrics map[string]*scriptedMetricConfig
+	// names of the built-in metrics, scripted metrics must not use them
+	builtinNames map[string]bool
+}
+
+// scripted metric names colliding with other metrics, see scriptedCollisions
+const (
+	collisionBuiltin  = "builtin"
+	collisionScripted = "scripted"
+)
+
+var scriptedCollisions = prometheus.NewDesc(
+	"kamailio_exporter_scripted_collisions",
+	"Scripted stats skipped by the last scrape because their metric collides with a builtin or another scripted metric",
+	[]string{"with"}, nil)
+
+// names of metrics produced by the exporter itself, besides the ones of the mappings
+var exporterMetricNames = []string{"kamailio_stat", "kamailio_stat_total", "kamailio_up", "kamailio_shv", "kamailio_shv_info"}
+
+// prefix of the exporter's own metrics of the default registry, e.g. kamailio_exporter_build_info
+const exporterMetricPrefix = "kamailio_exporter_"
+
+// names of the metrics the default registry serves with every scrape, like go_*, process_* and promhttp_*
+// metric vectors without series are missing. Gathering reads /proc, so callers do it once and keep the result.
+func defaultRegistryNames() map[string]bool {
+	families, _ := prometheus.DefaultGatherer.Gather()
+	names := make(map[string]bool, len(families))
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	return names
+}
+
+// check whether a metric name is taken by a metric of the default registry, given its names
+func isDefaultRegistryMetric(registryNames map[string]bool, name string) bool {
+	return strings.HasPrefix(name, exporterMetricPrefix) || registryNames[name]
+}
+
+// the declaration of a scripted metric in the config file
+type scriptedMetricConfig struct {
+	// counter or gauge, derived from the name if omitted
+	Type string `yaml:"type"`
+	Help string `yaml:"help"`
+	// base unit like "seconds" or "bytes", appended to the name unless it already ends with it
+	Unit string `yaml:"unit"`
+	// the metric name to use instead, without "kamailio_"
+	Rename string `yaml:"rename"`
+}
+
+var metricUnitRegexp = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+func checkScriptedMetricConfig(config *scriptedMetricConfig) error {
+	if config.Type != "" && config.Type != "counter" && config.Type != "gauge" {
+		return fmt.Errorf("unknown type %q, use one of counter or gauge", config.Type)
+	}
+	if config.Unit != "" && !metricUnitRegexp.MatchString(config.Unit) {
+		return fmt.Errorf("invalid unit %q", config.Unit)
+	}
+	if config.Rename != "" && !metricNameRegexp.MatchString(config.Rename) {
+		return fmt.Errorf("invalid metric name %q", config.Rename)
+	}
+	return nil
+}
+
+// the group of the stats of the statistics module, see defaultScriptedGroups
+const scriptGroupName = "script"
+
+// a stat group exported as scripted metrics, e.g. "billing" for the "billing.*" stats of a custom module
+type scriptedGroupConfig struct {
+	Group string `yaml:"group"`
+	// prepended to the metric names, "kamailio_<group>_" if omitted
+	MetricPrefix string `yaml:"metric_prefix"`
+	// counter or gauge for all stats of the group, derived from the name if omitted
+	Type string `yaml:"type"`
+	// metric names ending with one of these are counters, the others gauges
+	CounterSuffixes []string `yaml:"counter_suffixes"`
+}
+
+// see https://prometheus.io/docs/practices/naming/
+var defaultCounterSuffixes = []string{"_total", "_seconds", "_bytes"}
+
+// the "script." stats are always exported, unless the collector is disabled
+func defaultScriptedGroups() map[string]*scriptedGroupConfig {
+	return map[string]*scriptedGroupConfig{
+		scriptGroupName: {Group: scriptGroupName, MetricPrefix: "kamailio_", CounterSuffixes: defaultCounterSuffixes},
+	}
+}
+
+// validate a group and fill in the omitted fields
+func checkScriptedGroupConfig(config *scriptedGroupConfig) error {
+	if config.Group == "" || strings.Contains(config.Group, ".") || sanitizeMetricName(config.Group) == "" {
+		return fmt.Errorf("invalid group %q", config.Group)
+	}
+	if config.MetricPrefix == "" {
+		config.MetricPrefix = "kamailio_" + sanitizeMetricName(config.Group) + "_"
+		if config.Group == scriptGroupName {
+			config.MetricPrefix = "kamailio_"
+		}
+	}
+	if !metricNameRegexp.MatchString(config.MetricPrefix) {
+		return fmt.Errorf("invalid metric prefix %q", config.MetricPrefix)
+	}
+	if config.Type != "" && config.Type != "counter" && config.Type != "gauge" {
+		return fmt.Errorf("unknown type %q, use one of counter or gauge", config.Type)
+	}
+	if config.CounterSuffixes == nil {
+		config.CounterSuffixes = defaultCounterSuffixes
+	}
+	return nil
+}
+
+// the group of a stat key, nil if it is not exported as scripted metric
+func scriptedGroupOf(groups map[string]*scriptedGroupConfig, key string) *scriptedGroupConfig {
+	if i := strings.Index(key, "."); i > 0 {
+		return groups[key[:i]]
+	}
+	return nil
+}
+
+func newScriptedCollector(config *collectorConfig) (Collector, error) {
+	metrics := make(map[string]*scriptedMetricConfig)
+	for name, metric := range config.settings.scriptedMetrics {
+		metrics[strings.ToLower(name)] = metric
+	}
+	builtinNames := make(map[string]bool)
+	for _, mapping := range config.mappings {
+		builtinNames[mapping.name] = true
+	}
+	for _, name := range exporterMetricNames {
+		builtinNames[name] = true
+	}
+	for name := range defaultRegistryNames() {
+		builtinNames[name] = true
+	}
+	return &scriptedCollector{
+		groups:         config.settings.scriptedGroups,
+		mappings:       config.mappings,
+		labelSeparator: config.cliContext.String("scripted.labelSeparator"),
+		metrics:        metrics,
+		builtinNames:   builtinNames,
+	}, nil
+}
+
+func (c *scriptedCollector) Update(s *scrape, metricChannel chan<- prometheus.Metric) error {
+	completeStatMap, err := s.statMap()
+	if err != nil {
+		return err
+	}
+	c.convertScriptedMetrics(s, completeStatMap, metricChannel)
+	return nil
+}
+
+// a scripted stat, split into metric name and labels
+type scriptedStat struct {
+	key         string
+	group       *scriptedGroupConfig
+	name        string
+	labelNames  []string
+	labelValues []string
+}
+
+// Iterate all reported "stats" keys and find those of the scripted groups, e.g. "script."
+// Stats with the same metric name end up in one metric family, no matter their labels.
+// Stats following the histogram convention are assembled into histograms.
+func (c *scriptedCollector) convertScriptedMetrics(s *scrape, data map[string]string, prom chan<- prometheus.Metric) {
+	var keys []string
+	for k := range data {
+		if scriptedGroupOf(c.groups, k) != nil && !isMappedStat(c.mappings, k) {
+			keys = append(keys, k)
+		}
+	}
+	// sorted, so the same stat wins every time if variants conflict
+	sort.Strings(keys)
+
+	var stats []*scriptedStat
+	for _, k := range keys {
+		// k = "script.custom_total" or "script.calls_total__carrier__a"
+		stat, err := c.parseScriptedStat(scriptedGroupOf(c.groups, k), k)
+		if err != nil {
+			warnLimiter.Warnf(s.log, k, "Skipping scripted stat [%s]: %s", k, err)
+			continue
+		}
+		stats = append(stats, stat)
+	}
+	histograms, stats := collectScriptedHistograms(stats)
+
+	families := c.newScriptedFamilies()
+	for _, stat := range stats {
+		name, help, valueType := c.declaration(stat.name, "Scripted metric", stat.group)
+		kind := "gauge"
+		if valueType == prometheus.CounterValue {
+			kind = "counter"
+		}
+		description, err := families.description(stat.key, name, help, kind, stat.labelNames, stat.labelValues)
+		if err != nil {
+			warnLimiter.Warnf(s.log, stat.key, "Skipping scripted stat [%s]: %s", stat.key, err)
+			continue
+		}
+		// and produce a metric
+		convertStatToLabelledMetric(s, data, stat.key, stat.labelValues, description, prom, valueType)
+	}
+	for _, histogram := range histograms {
+		key := histogramKey(histogram.name, histogram.labelValues)
+		name, help, _ := c.declaration(histogram.name, "Scripted histogram", histogram.group)
+		description, err := families.description(histogram.firstKey(), name, help, "histogram", histogram.labelNames, histogram.labelValues)
+		if err == nil {
+			err = produceScriptedHistogram(s, histogram, data, description, prom)
+		}
+		if err != nil {
+			warnLimiter.Warnf(s.log, key, "Skipping scripted histogram %s %v: %s", histogram.name, histogram.labelValues, err)
+		}
+	}
+
+	for _, with := range []string{collisionBuiltin, collisionScripted} {
+		prom <- prometheus.MustNewConstMetric(scriptedCollisions, prometheus.GaugeValue, families.collisions[with], with)
+	}
+	// the catch-all must not use these names either
+	for name, family := range families.families {
+		s.names[name] = "scripted stat " + family.owner
+	}
+}
+
+// name, help text and type of a scripted metric as declared in the config file,
+// the undeclared ones follow the rules of their group
+func (c *scriptedCollector) declaration(name string, kind string, group *scriptedGroupConfig) (string, string, prometheus.ValueType) {
+	baseName := strings.TrimPrefix(name, "kamailio_")
+	help := kind + " " + baseName
+	valueType := group.valueType(name)
+	metric, ok := c.metrics[baseName]
+	if !ok {
+		return name, help, valueType
+	}
+
+	if metric.Rename != "" {
+		name = "kamailio_" + metric.Rename
+	}
+	if metric.Unit != "" {
+		// the unit goes before the "_total" of counters
+		withoutTotal := strings.TrimSuffix(name, "_total")
+		if !strings.HasSuffix(withoutTotal, "_"+metric.Unit) {
+			name = withoutTotal + "_" + metric.Unit + strings.TrimPrefix(name, withoutTotal)
+		}
+	}
+	if metric.Help != "" {
+		help = metric.Help
+	}
+	switch metric.Type {
+	case "counter":
+		valueType = prometheus.CounterValue
+	case "gauge":
+		valueType = prometheus.GaugeValue
+	}
+	return name, help, valueType
+}
+
+// a metric family of scripted stats
+type scriptedFamily struct {
+	description *prometheus.Desc
+	kind        string
+	labelNames  string
+	// the first stat of the family
+	owner string
+}
+
+// the metric families of the scripted stats of a scrape
+type scriptedFamilies struct {
+	builtinNames map[string]bool
+	// by name, histograms are also found by the names of their _bucket, _sum and _count series
+	families map[string]*scriptedFamily
+	// the stat producing a series, by name and label values
+	series     map[string]string
+	collisions map[string]float64
+}
+
+func (c *scriptedCollector) newScriptedFamilies() *scriptedFamilies {
+	return &scriptedFamilies{
+		builtinNames: c.builtinNames,
+		families:     make(map[string]*scriptedFamily),
+		series:       make(map[string]string),
+		collisions:   make(map[string]float64),
+	}
+}
+
+// the description of a metric family, created on the fly
+// all variants of a metric must have the same type and labels, and produce different series.
+// An error is returned if the stat collides with a built-in or another scripted metric.
+func (f *scriptedFamilies) description(key string, name string, help string, kind string, labelNames []string, labelValues []string) (*prometheus.Desc, error) {
+	names := []string{name}
+	if kind == "histogram" {
+		names = append(names, name+"_bucket", name+"_sum", name+"_count")
+	}
+	for _, name := range names {
+		if f.builtinNames[name] || strings.HasPrefix(name, exporterMetricPrefix) {
+			f.collisions[collisionBuiltin]++
+			return nil, fmt.Errorf("metric %s collides with a built-in metric", name)
+		}
+	}
+
+	joinedLabelNames := strings.Join(labelNames, ",")
+	family, ok := f.families[name]
+	if ok {
+		switch {
+		case family.description == nil:
+			f.collisions[collisionScripted]++
+			return nil, fmt.Errorf("metric %s collides with a series of the histogram of scripted stat %s", name, family.owner)
+		case family.kind != kind:
+			f.collisions[collisionScripted]++
+			return nil, fmt.Errorf("metric %s is already a %s, see scripted stat %s", name, family.kind, family.owner)
+		case family.labelNames != joinedLabelNames:
+			f.collisions[collisionScripted]++
+			return nil, fmt.Errorf("metric %s already has the labels [%s], see scripted stat %s", name, family.labelNames, family.owner)
+		}
+	} else {
+		for _, seriesName := range names[1:] {
+			if other, ok := f.families[seriesName]; ok {
+				f.collisions[collisionScripted]++
+				return nil, fmt.Errorf("histogram %s collides with metric %s of scripted stat %s", name, seriesName, other.owner)
+			}
+		}
+		family = &scriptedFamily{
+			description: prometheus.NewDesc(name, help, labelNames, nil),
+			kind:        kind,
+			labelNames:  joinedLabelNames,
+			owner:       key,
+		}
+		f.families[name] = family
+		for _, seriesName := range names[1:] {
+			f.families[seriesName] = &scriptedFamily{owner: key}
+		}
+	}
+
+	series := histogramKey(name, labelValues)
+	if other, ok := f.series[series]; ok {
+		f.collisions[collisionScripted]++
+		return nil, fmt.Errorf("same metric and labels as scripted stat %s", other)
+	}
+	f.series[series] = key
+	return family.description, nil
+}
+
+// split a scripted stat name into metric name and labels, e.g.
+// "script.calls_total__carrier__a__dir__out" => kamailio_calls_total{carrier="a",dir="out"}
+// metric and label names are lower-cased and invalid characters replaced by "_",
+// label values are kept as they are
+// names without a valid label encoding, like "script.foo__bar", are exported without labels as before, kamailio_foo__bar
+func (c *scriptedCollector) parseScriptedStat(group *scriptedGroupConfig, key string) (*scriptedStat, error) {
+	name := strings.TrimPrefix(key, group.Group+".")
+	if c.labelSeparator != "" {
+		parts := strings.Split(name, c.labelSeparator)
+		if stat, err := parseScriptedLabels(parts); err == nil {
+			if metricName := sanitizeMetricName(parts[0]); metricName != "" {
+				stat.key, stat.group, stat.name = key, group, group.MetricPrefix+metricName
+				return stat, nil
+			}
+		}
+	}
+
+	metricName := sanitizeMetricName(name)
+	if metricName == "" {
+		return nil, fmt.Errorf("no valid metric name")
+	}
+	return &scriptedStat{key: key, group: group, name: group.MetricPrefix + metricName}, nil
+}
+
+// the labels of a scripted stat name split at the separator, the metric name comes first
+func parseScriptedLabels(parts []string) (*scriptedStat, error) {
+	if len(parts)%2 == 0 {
+		return nil, fmt.Errorf("expected pairs of label name and value after the metric name")
+	}
+	stat := &scriptedStat{}
+	// labels in order of their names, as the variants of a metric may list them in any order
+	labels := make(map[string]string)
+	for i := 1; i < len(parts); i += 2 {
+		labelName := sanitizeMetricName(parts[i])
+		if !labelNameRegexp.MatchString(labelName) {
+			return nil, fmt.Errorf("invalid label name %q", parts[i])
+		}
+		if _, ok := labels[labelName]; ok {
+			return nil, fmt.Errorf("label %s is given more than once", labelName)
+		}
+		if parts[i+1] == "" {
+			return nil, fmt.Errorf("the value of label %s is empty", labelName)
+		}
+		labels[labelName] = parts[i+1]
+		stat.labelNames = append(stat.labelNames, labelName)
+	}
+	sort.Strings(stat.labelNames)
+	for _, labelName := range stat.labelNames {
+		stat.labelValues = append(stat.labelValues, labels[labelName])
+	}
+	return stat, nil
+}
+
+// deduce the metrics value type from the type or the counter suffixes of the group
+func (g *scriptedGroupConfig) valueType(name string) prometheus.ValueType {
+	switch g.Type {
+	case "counter":
+		return prometheus.CounterValue
+	case "gauge":
+		return prometheus.GaugeValue
+	}
+	for _, suffix := range g.CounterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return prometheus.CounterValue
+		}
+	}
+	return prometheus.GaugeValue
+}
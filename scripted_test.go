@@ -0,0 +1,480 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// a collector calling a function, to gather the metrics it produces
+type collectorFunc func(metricChannel chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(chan<- *prometheus.Desc) {}
+
+func (f collectorFunc) Collect(metricChannel chan<- prometheus.Metric) {
+	f(metricChannel)
+}
+
+// the metric families produced by a function, sorted by name
+func gatherFamilies(t *testing.T, produce collectorFunc) []*dto.MetricFamily {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(produce)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+// a scrape without series limits
+func newTestScrape() *scrape {
+	limits, _ := newSeriesLimits(0, 0, nil, seriesLimitDrop)
+	return newScrape(nil, limits)
+}
+
+func TestParseScriptedStat(t *testing.T) {
+	group := &scriptedGroupConfig{Group: "script", MetricPrefix: "kamailio_"}
+	tests := []struct {
+		key         string
+		separator   string
+		name        string
+		labelNames  []string
+		labelValues []string
+	}{
+		{"script.calls_total", "__", "kamailio_calls_total", nil, nil},
+		{"script.calls_total__carrier__a__dir__out", "__", "kamailio_calls_total", []string{"carrier", "dir"}, []string{"a", "out"}},
+		{"script.calls_total__Dir__out__carrier__A", "__", "kamailio_calls_total", []string{"carrier", "dir"}, []string{"A", "out"}},
+		{"script.calls_total__carrier__a", "", "kamailio_calls_total__carrier__a", nil, nil},
+		// names without a valid label encoding keep their name
+		{"script.foo__bar", "__", "kamailio_foo__bar", nil, nil},
+		{"script.foo__1x__bar", "__", "kamailio_foo__1x__bar", nil, nil},
+		{"script.foo__x__", "__", "kamailio_foo__x", nil, nil},
+		{"script.foo__x__a__x__b", "__", "kamailio_foo__x__a__x__b", nil, nil},
+		{"script.__x__a", "__", "kamailio_x__a", nil, nil},
+	}
+	for _, test := range tests {
+		c := &scriptedCollector{labelSeparator: test.separator}
+		stat, err := c.parseScriptedStat(group, test.key)
+		if err != nil {
+			t.Errorf("%s: %s", test.key, err)
+			continue
+		}
+		if stat.name != test.name || !reflect.DeepEqual(stat.labelNames, test.labelNames) || !reflect.DeepEqual(stat.labelValues, test.labelValues) {
+			t.Errorf("%s: got %s %v %v, want %s %v %v", test.key, stat.name, stat.labelNames, stat.labelValues, test.name, test.labelNames, test.labelValues)
+		}
+	}
+	if _, err := (&scriptedCollector{labelSeparator: "__"}).parseScriptedStat(group, "script.__"); err == nil {
+		t.Errorf("expected an error for a stat without a valid name")
+	}
+}
+
+func TestScriptedCollisions(t *testing.T) {
+	histogram := map[string]string{
+		"script.pdd_seconds_bucket_le_1":   "2",
+		"script.pdd_seconds_bucket_le_inf": "3",
+		"script.pdd_seconds_sum":           "4.5",
+		"script.pdd_seconds_count":         "3",
+	}
+	with := func(stats map[string]string, key string, value string) map[string]string {
+		result := map[string]string{key: value}
+		for k, v := range stats {
+			result[k] = v
+		}
+		return result
+	}
+	tests := []struct {
+		name         string
+		builtinNames map[string]bool
+		data         map[string]string
+		// the produced metrics and their number of series
+		metrics  map[string]int
+		builtin  float64
+		scripted float64
+	}{
+		{
+			"name of a built-in mapping",
+			map[string]bool{"kamailio_sl_replies_total": true},
+			map[string]string{"script.sl_replies_total": "1", "script.calls_total": "2"},
+			map[string]int{"kamailio_calls_total": 1}, 1, 0,
+		},
+		{
+			"name of an exporter metric",
+			nil,
+			map[string]string{"script.exporter_scrapes_total": "1"},
+			map[string]int{}, 1, 0,
+		},
+		{
+			"same name after sanitizing",
+			nil,
+			map[string]string{"script.Active-Calls": "1", "script.active_calls": "2"},
+			map[string]int{"kamailio_active_calls": 1}, 0, 1,
+		},
+		{
+			"same name with other labels",
+			nil,
+			map[string]string{"script.calls": "1", "script.calls__dir__in": "2", "script.calls__dir__out": "3"},
+			map[string]int{"kamailio_calls": 1}, 0, 2,
+		},
+		{
+			"histogram",
+			nil,
+			histogram,
+			map[string]int{"kamailio_pdd_seconds": 1}, 0, 0,
+		},
+		{
+			"bucket name of a histogram taken by a scripted stat",
+			nil,
+			with(histogram, "script.pdd_seconds_bucket", "7"),
+			map[string]int{"kamailio_pdd_seconds_bucket": 1}, 0, 1,
+		},
+		{
+			"count name of a histogram taken by a built-in metric",
+			map[string]bool{"kamailio_pdd_seconds_count": true},
+			histogram,
+			map[string]int{}, 1, 0,
+		},
+	}
+	for _, test := range tests {
+		c := &scriptedCollector{groups: defaultScriptedGroups(), labelSeparator: "__", builtinNames: test.builtinNames}
+		families := gatherFamilies(t, func(metricChannel chan<- prometheus.Metric) {
+			c.convertScriptedMetrics(newTestScrape(), test.data, metricChannel)
+		})
+		metrics := make(map[string]int)
+		collisions := make(map[string]float64)
+		for _, family := range families {
+			if family.GetName() != "kamailio_exporter_scripted_collisions" {
+				metrics[family.GetName()] = len(family.Metric)
+				continue
+			}
+			for _, metric := range family.Metric {
+				collisions[metric.Label[0].GetValue()] = metric.Gauge.GetValue()
+			}
+		}
+		if !reflect.DeepEqual(metrics, test.metrics) {
+			t.Errorf("%s: got metrics %v, want %v", test.name, metrics, test.metrics)
+		}
+		if collisions[collisionBuiltin] != test.builtin || collisions[collisionScripted] != test.scripted {
+			t.Errorf("%s: got collisions %v, want %v builtin and %v scripted", test.name, collisions, test.builtin, test.scripted)
+		}
+	}
+}
+
+// the scripted stats of the given keys, parsed like convertScriptedMetrics does
+func parseScriptedStats(t *testing.T, keys []string) []*scriptedStat {
+	t.Helper()
+	sort.Strings(keys)
+	c := &scriptedCollector{labelSeparator: "__"}
+	group := defaultScriptedGroups()[scriptGroupName]
+	var stats []*scriptedStat
+	for _, key := range keys {
+		stat, err := c.parseScriptedStat(group, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func TestCollectScriptedHistograms(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		// bucket bounds by histogram, and the names of the remaining stats
+		histograms map[string][]float64
+		remaining  []string
+	}{
+		{
+			"buckets",
+			[]string{"script.pdd_seconds_bucket_le_0_5", "script.pdd_seconds_bucket_le_1", "script.pdd_seconds_bucket_le_inf", "script.pdd_seconds_sum", "script.pdd_seconds_count"},
+			map[string][]float64{"kamailio_pdd_seconds": {0.5, 1, math.Inf(1)}},
+			nil,
+		},
+		{
+			"labels make different histograms",
+			[]string{"script.pdd_seconds_bucket_le_1__dir__in", "script.pdd_seconds_bucket_le_1__dir__out", "script.pdd_seconds_sum__dir__in"},
+			map[string][]float64{"kamailio_pdd_seconds{in}": {1}, "kamailio_pdd_seconds{out}": {1}},
+			nil,
+		},
+		{
+			"sum and count without buckets are no histogram",
+			[]string{"script.pdd_seconds_sum", "script.pdd_seconds_count", "script.size_bucket_le_1"},
+			map[string][]float64{"kamailio_size": {1}},
+			[]string{"kamailio_pdd_seconds_count", "kamailio_pdd_seconds_sum"},
+		},
+		{
+			"invalid bounds are no bucket",
+			[]string{"script.size_bucket_le_1_5_5", "script.size_bucket_le_x", "script.size_bucket"},
+			map[string][]float64{},
+			[]string{"kamailio_size_bucket", "kamailio_size_bucket_le_1_5_5", "kamailio_size_bucket_le_x"},
+		},
+	}
+	for _, test := range tests {
+		histograms, remaining := collectScriptedHistograms(parseScriptedStats(t, test.keys))
+		bounds := make(map[string][]float64)
+		for _, histogram := range histograms {
+			key := histogram.name
+			if len(histogram.labelValues) > 0 {
+				key += "{" + strings.Join(histogram.labelValues, ",") + "}"
+			}
+			for bound := range histogram.buckets {
+				bounds[key] = append(bounds[key], bound)
+			}
+			sort.Float64s(bounds[key])
+		}
+		var names []string
+		for _, stat := range remaining {
+			names = append(names, stat.name)
+		}
+		if !reflect.DeepEqual(bounds, test.histograms) || !reflect.DeepEqual(names, test.remaining) {
+			t.Errorf("%s: got histograms %v and stats %v, want %v and %v", test.name, bounds, names, test.histograms, test.remaining)
+		}
+	}
+}
+
+func TestProduceScriptedHistogram(t *testing.T) {
+	desc := prometheus.NewDesc("kamailio_pdd_seconds", "Post dial delay", nil, nil)
+	tests := []struct {
+		name string
+		data map[string]string
+		// the expected histogram, or a part of the error
+		count   uint64
+		sum     float64
+		buckets map[float64]uint64
+		err     string
+	}{
+		{
+			"+Inf bucket without count",
+			map[string]string{"script.pdd_seconds_bucket_le_0_5": "1", "script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_bucket_le_inf": "4", "script.pdd_seconds_sum": "2.5"},
+			4, 2.5, map[float64]uint64{0.5: 1, 1: 3}, "",
+		},
+		{
+			"count without +Inf bucket",
+			map[string]string{"script.pdd_seconds_bucket_le_0_5": "1", "script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_sum": "6", "script.pdd_seconds_count": "5"},
+			5, 6, map[float64]uint64{0.5: 1, 1: 3}, "",
+		},
+		{
+			"count matching the +Inf bucket",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_bucket_le_inf": "4", "script.pdd_seconds_sum": "6", "script.pdd_seconds_count": "4"},
+			4, 6, map[float64]uint64{1: 3}, "",
+		},
+		{
+			"buckets not cumulative",
+			map[string]string{"script.pdd_seconds_bucket_le_0_5": "3", "script.pdd_seconds_bucket_le_1": "2", "script.pdd_seconds_sum": "1", "script.pdd_seconds_count": "3"},
+			0, 0, nil, "not cumulative",
+		},
+		{
+			"+Inf bucket lower than a bucket",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_bucket_le_inf": "2", "script.pdd_seconds_sum": "1"},
+			0, 0, nil, "not cumulative",
+		},
+		{
+			"count differing from the +Inf bucket",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_bucket_le_inf": "4", "script.pdd_seconds_sum": "6", "script.pdd_seconds_count": "5"},
+			0, 0, nil, "differs from",
+		},
+		{
+			"count lower than the buckets",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_sum": "6", "script.pdd_seconds_count": "2"},
+			0, 0, nil, "lower than the buckets",
+		},
+		{
+			"sum missing",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_bucket_le_inf": "4"},
+			0, 0, nil, "_sum is missing",
+		},
+		{
+			"count and +Inf bucket missing",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "3", "script.pdd_seconds_sum": "6"},
+			0, 0, nil, "+Inf bucket are missing",
+		},
+		{
+			"invalid value",
+			map[string]string{"script.pdd_seconds_bucket_le_1": "many", "script.pdd_seconds_sum": "6", "script.pdd_seconds_count": "4"},
+			0, 0, nil, "invalid value",
+		},
+	}
+	for _, test := range tests {
+		var keys []string
+		for key := range test.data {
+			keys = append(keys, key)
+		}
+		histograms, _ := collectScriptedHistograms(parseScriptedStats(t, keys))
+		if len(histograms) != 1 {
+			t.Fatalf("%s: got %d histograms, want 1", test.name, len(histograms))
+		}
+		metricChannel := make(chan prometheus.Metric, 1)
+		err := produceScriptedHistogram(newTestScrape(), histograms[0], test.data, desc, metricChannel)
+		close(metricChannel)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var m dto.Metric
+		if err := (<-metricChannel).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		buckets := make(map[float64]uint64)
+		for _, bucket := range m.Histogram.Bucket {
+			buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+		}
+		if m.Histogram.GetSampleCount() != test.count || m.Histogram.GetSampleSum() != test.sum || !reflect.DeepEqual(buckets, test.buckets) {
+			t.Errorf("%s: got %v, want count %d sum %v buckets %v", test.name, m.Histogram, test.count, test.sum, test.buckets)
+		}
+	}
+}
+
+func TestScriptedDeclaration(t *testing.T) {
+	c := &scriptedCollector{metrics: map[string]*scriptedMetricConfig{
+		"pdd":              {Unit: "seconds", Help: "Post dial delay"},
+		"calls_total":      {Unit: "seconds"},
+		"setup_seconds":    {Unit: "seconds", Type: "gauge"},
+		"active":           {Rename: "calls_active", Type: "counter"},
+		"reg_failed_total": {Rename: "registrations_failed_total"},
+	}}
+	group := defaultScriptedGroups()[scriptGroupName]
+	tests := []struct {
+		name      string
+		result    string
+		help      string
+		valueType prometheus.ValueType
+	}{
+		// undeclared metrics follow their group
+		{"kamailio_calls", "kamailio_calls", "Scripted metric calls", prometheus.GaugeValue},
+		{"kamailio_invites_total", "kamailio_invites_total", "Scripted metric invites_total", prometheus.CounterValue},
+		{"kamailio_pdd", "kamailio_pdd_seconds", "Post dial delay", prometheus.GaugeValue},
+		// the unit goes before "_total", and is not repeated
+		{"kamailio_calls_total", "kamailio_calls_seconds_total", "Scripted metric calls_total", prometheus.CounterValue},
+		{"kamailio_setup_seconds", "kamailio_setup_seconds", "Scripted metric setup_seconds", prometheus.GaugeValue},
+		{"kamailio_active", "kamailio_calls_active", "Scripted metric active", prometheus.CounterValue},
+		{"kamailio_reg_failed_total", "kamailio_registrations_failed_total", "Scripted metric reg_failed_total", prometheus.CounterValue},
+	}
+	for _, test := range tests {
+		name, help, valueType := c.declaration(test.name, "Scripted metric", group)
+		if name != test.result || help != test.help || valueType != test.valueType {
+			t.Errorf("%s: got %s %q %v, want %s %q %v", test.name, name, help, valueType, test.result, test.help, test.valueType)
+		}
+	}
+}
+
+func TestCheckScriptedMetricConfig(t *testing.T) {
+	tests := []struct {
+		config scriptedMetricConfig
+		err    bool
+	}{
+		{scriptedMetricConfig{Type: "counter", Unit: "seconds", Rename: "setup_seconds_total"}, false},
+		{scriptedMetricConfig{Type: "histogram"}, true},
+		{scriptedMetricConfig{Unit: "Seconds"}, true},
+		{scriptedMetricConfig{Unit: "milli-seconds"}, true},
+		{scriptedMetricConfig{Rename: "calls-active"}, true},
+	}
+	for _, test := range tests {
+		if err := checkScriptedMetricConfig(&test.config); (err != nil) != test.err {
+			t.Errorf("%+v: unexpected error %v", test.config, err)
+		}
+	}
+}
+
+func TestCheckScriptedGroupConfig(t *testing.T) {
+	tests := []struct {
+		config scriptedGroupConfig
+		prefix string
+		err    bool
+	}{
+		{scriptedGroupConfig{Group: "billing"}, "kamailio_billing_", false},
+		{scriptedGroupConfig{Group: "nat-traversal"}, "kamailio_nat_traversal_", false},
+		{scriptedGroupConfig{Group: "script"}, "kamailio_", false},
+		{scriptedGroupConfig{Group: "billing", MetricPrefix: "billing_"}, "billing_", false},
+		{scriptedGroupConfig{Group: ""}, "", true},
+		{scriptedGroupConfig{Group: "billing.calls"}, "", true},
+		{scriptedGroupConfig{Group: "-"}, "", true},
+		{scriptedGroupConfig{Group: "billing", MetricPrefix: "1billing_"}, "", true},
+		{scriptedGroupConfig{Group: "billing", Type: "histogram"}, "", true},
+	}
+	for _, test := range tests {
+		err := checkScriptedGroupConfig(&test.config)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error %v", test.config.Group, err)
+			continue
+		}
+		if err == nil && (test.config.MetricPrefix != test.prefix || test.config.CounterSuffixes == nil) {
+			t.Errorf("%q: got prefix %q and suffixes %v, want %q and the default suffixes", test.config.Group, test.config.MetricPrefix, test.config.CounterSuffixes, test.prefix)
+		}
+	}
+}
+
+func TestScriptedGroupValueType(t *testing.T) {
+	tests := []struct {
+		group     scriptedGroupConfig
+		name      string
+		valueType prometheus.ValueType
+	}{
+		{scriptedGroupConfig{CounterSuffixes: defaultCounterSuffixes}, "kamailio_calls_total", prometheus.CounterValue},
+		{scriptedGroupConfig{CounterSuffixes: defaultCounterSuffixes}, "kamailio_calls", prometheus.GaugeValue},
+		{scriptedGroupConfig{CounterSuffixes: []string{"_count"}}, "kamailio_calls_count", prometheus.CounterValue},
+		{scriptedGroupConfig{CounterSuffixes: []string{"_count"}}, "kamailio_calls_total", prometheus.GaugeValue},
+		{scriptedGroupConfig{Type: "counter", CounterSuffixes: defaultCounterSuffixes}, "kamailio_calls", prometheus.CounterValue},
+		{scriptedGroupConfig{Type: "gauge", CounterSuffixes: defaultCounterSuffixes}, "kamailio_calls_total", prometheus.GaugeValue},
+	}
+	for _, test := range tests {
+		if valueType := test.group.valueType(test.name); valueType != test.valueType {
+			t.Errorf("%+v %s: got %v, want %v", test.group, test.name, valueType, test.valueType)
+		}
+	}
+}
+
+// the stats of the configured groups are exported, unless a mapping covers them
+func TestScriptedGroups(t *testing.T) {
+	billing := &scriptedGroupConfig{Group: "billing"}
+	sl := &scriptedGroupConfig{Group: "sl", Type: "counter"}
+	for _, group := range []*scriptedGroupConfig{billing, sl} {
+		if err := checkScriptedGroupConfig(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups := defaultScriptedGroups()
+	groups["billing"], groups["sl"] = billing, sl
+	mapping, err := newMetricMapping(metricMappingConfig{Name: "kamailio_sl_failures_total", Help: "Stateless failures", Stats: []statMappingConfig{{Key: "sl.failures"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &scriptedCollector{groups: groups, mappings: []*metricMapping{mapping}, labelSeparator: "__"}
+	data := map[string]string{
+		"script.calls_total":         "1",
+		"billing.cdrs_total":         "2",
+		"billing.open_cdrs__dir__in": "3",
+		"sl.failures":                "4",
+		"sl.custom":                  "5",
+		"tmx.active_transactions":    "6",
+	}
+	families := gatherFamilies(t, func(metricChannel chan<- prometheus.Metric) {
+		c.convertScriptedMetrics(newTestScrape(), data, metricChannel)
+	})
+	types := make(map[string]string)
+	for _, family := range families {
+		if family.GetName() != "kamailio_exporter_scripted_collisions" {
+			types[family.GetName()] = family.GetType().String()
+		}
+	}
+	expected := map[string]string{
+		"kamailio_calls_total":        "COUNTER",
+		"kamailio_billing_cdrs_total": "COUNTER",
+		"kamailio_billing_open_cdrs":  "GAUGE",
+		"kamailio_sl_custom":          "COUNTER",
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("got %v, want %v", types, expected)
+	}
+}
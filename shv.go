@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	shvValue = prometheus.NewDesc(
+		"kamailio_shv",
+		"Numeric shared variables ($shv) of the kamailio script",
+		[]string{"name"}, nil)
+
+	shvInfo = prometheus.NewDesc(
+		"kamailio_shv_info",
+		"String shared variables ($shv) of the kamailio script, the value is a label",
+		[]string{"name", "value"}, nil)
+)
+
+// a collector producing the shared variables of the config file
+// See https://www.kamailio.org/docs/modules/5.2.x/modules/pv.html#pv.rpc.shvGet
+type shvCollector struct {
+	names []string
+}
+
+func newShvCollector(config *collectorConfig) (Collector, error) {
+	return &shvCollector{names: config.settings.sharedVariables}, nil
+}
+
+func (c *shvCollector) Update(s *scrape, metricChannel chan<- prometheus.Metric) error {
+	for _, name := range c.names {
+		value, err := fetchSharedVariable(s.rpc, name)
+		if err != nil {
+			warnLimiter.Warnf(s.log, "shv:"+name, "Could not read shared variable %s: %s", name, err)
+			continue
+		}
+		switch v := value.(type) {
+		case int:
+			err = s.sendMetric(metricChannel, shvValue, prometheus.GaugeValue, float64(v), name)
+		case string:
+			err = s.sendMetric(metricChannel, shvInfo, prometheus.GaugeValue, 1, name, v)
+		}
+		if err != nil {
+			warnLimiter.Warnf(s.log, "shv:"+name, "Skipping shared variable %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// perform a "pv.shvGet" rpc call, the value is either int or string
+func fetchSharedVariable(rpc *rpcSession, name string) (interface{}, error) {
+	values, err := rpc.callValues("pv.shvGet", name)
+	if err != nil {
+		return nil, err
+	}
+
+	// a struct {name, type, value}, some versions wrap it into an array
+	var candidates []interface{}
+	for _, value := range values {
+		if list, ok := value.([]interface{}); ok {
+			candidates = append(candidates, list...)
+		} else {
+			candidates = append(candidates, value)
+		}
+	}
+	for _, candidate := range candidates {
+		members, ok := candidate.([]rpcMember)
+		if !ok {
+			continue
+		}
+		if found, _ := rpcMemberValue(members, "name"); found != name {
+			continue
+		}
+		switch value, _ := rpcMemberValue(members, "value"); value.(type) {
+		case int, string:
+			return value, nil
+		}
+		return nil, fmt.Errorf("unexpected pv.shvGet response, the value is missing")
+	}
+	return nil, fmt.Errorf("not returned by pv.shvGet")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/florentchauveau/go-kamailio-binrpc/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// a connection to a fake kamailio answering the requests in order with the given payloads
+func fakeRPCDial(payloads ...[]byte) func(*log.Entry) (net.Conn, error) {
+	return func(*log.Entry) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			reader := bufio.NewReader(server)
+			for _, payload := range payloads {
+				header, err := binrpc.ReadHeader(reader)
+				if err != nil {
+					return
+				}
+				if _, err := io.CopyN(io.Discard, reader, int64(header.PayloadLength)); err != nil {
+					return
+				}
+				// a length of 4 bytes and the cookie of the request
+				response := []byte{binrpc.BinRPCMagic<<4 | binrpc.BinRPCVersion, 3<<2 | byte(len(header.Cookie)-1)}
+				response = append(response, byte(len(payload)>>24), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+				response = append(response, header.Cookie...)
+				if _, err := server.Write(append(response, payload...)); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	}
+}
+
+// the response of pv.shvGet for a variable
+func shvResponse(name string, value []byte) []byte {
+	return concat(
+		rpcRecord(binrpc.TypeStruct),
+		rpcString(binrpc.TypeAVP, "name"), rpcString(binrpc.TypeString, name),
+		rpcString(binrpc.TypeAVP, "type"), rpcString(binrpc.TypeString, "int"),
+		rpcString(binrpc.TypeAVP, "value"), value,
+		rpcEnd(binrpc.TypeStruct),
+	)
+}
+
+func TestShvCollector(t *testing.T) {
+	c := &shvCollector{names: []string{"calls", "mode", "missing", "wrapped"}}
+	dial := fakeRPCDial(
+		shvResponse("calls", rpcRecord(binrpc.TypeInt, 42)),
+		shvResponse("mode", rpcString(binrpc.TypeString, "maint")),
+		concat(rpcRecord(binrpc.TypeInt, 0x01, 0xF4), rpcString(binrpc.TypeString, "not found")),
+		// some versions wrap the struct into an array
+		concat(rpcRecord(binrpc.TypeArray), shvResponse("wrapped", rpcRecord(binrpc.TypeInt, 0xFF, 0xFF, 0xFF, 0xFF)), rpcEnd(binrpc.TypeArray)),
+	)
+	families := gatherFamilies(t, func(metricChannel chan<- prometheus.Metric) {
+		limits, _ := newSeriesLimits(0, 0, nil, seriesLimitDrop)
+		s := newScrape(dial, limits)
+		defer s.close()
+		if err := c.Update(s, metricChannel); err != nil {
+			t.Error(err)
+		}
+	})
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			key := family.GetName()
+			for _, label := range metric.Label {
+				key += " " + label.GetName() + "=" + label.GetValue()
+			}
+			series[key] = metric.Gauge.GetValue()
+		}
+	}
+	// numeric variables are values, strings are labels of an info metric
+	expected := map[string]float64{
+		"kamailio_shv name=calls":                 42,
+		"kamailio_shv name=wrapped":               -1,
+		"kamailio_shv_info name=mode value=maint": 1,
+	}
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("got %v, want %v", series, expected)
+	}
+}
@@ -6,128 +6,91 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/florentchauveau/go-kamailio-binrpc/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/urfave/cli.v1"
 )
 
-// declare a series of prometheus metric descriptions
-// we can reuse them for each scrape
-var (
-	core_request_total = prometheus.NewDesc(
-		"kamailio_core_request_total",
-		"Request counters",
-		[]string{"method"}, nil)
-
-	core_rcv_request_total = prometheus.NewDesc(
-		"kamailio_core_rcv_request_total",
-		"Received requests by method",
-		[]string{"method"}, nil)
-
-	core_reply_total = prometheus.NewDesc(
-		"kamailio_core_reply_total",
-		"Reply counters",
-		[]string{"type"}, nil)
-
-	core_rcv_reply_total = prometheus.NewDesc(
-		"kamailio_core_rcv_reply_total",
-		"Received replies by code",
-		[]string{"code"}, nil)
-
-	shmem_bytes = prometheus.NewDesc(
-		"kamailio_shm_bytes",
-		"Shared memory sizes",
-		[]string{"type"}, nil)
-
-	shmem_fragments = prometheus.NewDesc(
-		"kamailio_shm_fragments",
-		"Shared memory fragment count",
-		[]string{}, nil)
-
-	dns_failed = prometheus.NewDesc(
-		"kamailio_dns_failed_request_total",
-		"Failed dns requests",
-		[]string{}, nil)
-
-	bad_uri = prometheus.NewDesc(
-		"kamailio_bad_uri_total",
-		"Messages with bad uri",
-		[]string{}, nil)
-
-	bad_msg_hdr = prometheus.NewDesc(
-		"kamailio_bad_msg_hdr",
-		"Messages with bad message header",
-		[]string{}, nil)
-
-	sl_reply_total = prometheus.NewDesc(
-		"kamailio_sl_reply_total",
-		"Stateless replies by code",
-		[]string{"code"}, nil)
-
-	sl_type_total = prometheus.NewDesc(
-		"kamailio_sl_type_total",
-		"Stateless replies by type",
-		[]string{"type"}, nil)
-
-	tcp_total = prometheus.NewDesc(
-		"kamailio_tcp_total",
-		"TCP connection counters",
-		[]string{"type"}, nil)
-
-	tcp_connections = prometheus.NewDesc(
-		"kamailio_tcp_connections",
-		"Opened TCP connections",
-		[]string{}, nil)
-
-	tcp_writequeue = prometheus.NewDesc(
-		"kamailio_tcp_writequeue",
-		"TCP write queue size",
-		[]string{}, nil)
-
-	tmx_code_total = prometheus.NewDesc(
-		"kamailio_tmx_code_total",
-		"Completed Transaction counters by code",
-		[]string{"code"}, nil)
-
-	tmx_type_total = prometheus.NewDesc(
-		"kamailio_tmx_type_total",
-		"Completed Transaction counters by type",
-		[]string{"type"}, nil)
-
-	tmx = prometheus.NewDesc(
-		"kamailio_tmx",
-		"Ongoing Transactions",
-		[]string{"type"}, nil)
-
-	tmx_rpl_total = prometheus.NewDesc(
-		"kamailio_tmx_rpl_total",
-		"Tmx reply counters",
-		[]string{"type"}, nil)
-
-	dialog = prometheus.NewDesc(
-		"kamailio_dialog",
-		"Ongoing Dialogs",
-		[]string{"type"}, nil)
-)
-
 // the actual Collector object
 type StatsCollector struct {
 	cliContext   *cli.Context
 	socketPath   string
 	kamailioHost string
 	kamailioPort int
+	mappings     []*metricMapping
+	catchAll     string
+	// stats of these groups are left to the scripted collector
+	scriptedGroups map[string]*scriptedGroupConfig
+	compat         string
+	scrapes        *scrapeCounters
+	limits         *seriesLimits
+	enabled        map[string]bool
+	collectors     []namedCollector
 }
 
 // produce a new StatsCollector object
-func NewStatsCollector(cliContext *cli.Context) (*StatsCollector, error) {
+func NewStatsCollector(cliContext *cli.Context, settings *exporterSettings) (*StatsCollector, error) {
+
+	// the metric schema and compatibility mode decide which mappings are built in
+	compat := cliContext.String("metrics.compat")
+	builtin, err := builtinMappings(cliContext.String("metrics.schema"), compat)
+	if err != nil {
+		return nil, err
+	}
+	// load the metric mappings, invalid files prevent the startup
+	mappingFile := cliContext.String("mappingFile")
+	if settings.mappingFile != "" {
+		mappingFile = settings.mappingFile
+	}
+	mappings, err := loadMappings(mappingFile, builtin)
+	if err != nil {
+		return nil, err
+	}
+
+	catchAll := cliContext.String("catchAll")
+	if catchAll != catchAllOff && catchAll != catchAllLabels && catchAll != catchAllNames {
+		return nil, fmt.Errorf("unknown catch-all mode %q, use one of off, labels or names", catchAll)
+	}
+
+	limits, err := newSeriesLimits(cliContext.Int("series.limit"), cliContext.Int("series.collectorLimit"),
+		settings.seriesLimits, cliContext.String("series.limitAction"))
+	if err != nil {
+		return nil, err
+	}
+
+	// create the enabled collectors
+	enabled := enabledCollectors(cliContext)
+	for name, isEnabled := range settings.collectors {
+		enabled[name] = isEnabled
+	}
+	collectors, err := newCollectors(&collectorConfig{cliContext: cliContext, settings: settings, mappings: mappings}, enabled)
+	if err != nil {
+		return nil, err
+	}
 
 	// fill the Collector struct
 	collector := &StatsCollector{
-		cliContext:   cliContext,
-		socketPath:   cliContext.String("socketPath"),
-		kamailioHost: cliContext.String("host"),
-		kamailioPort: cliContext.Int("port"),
+		cliContext:     cliContext,
+		socketPath:     cliContext.String("socketPath"),
+		kamailioHost:   cliContext.String("host"),
+		kamailioPort:   cliContext.Int("port"),
+		mappings:       mappings,
+		catchAll:       catchAll,
+		scriptedGroups: settings.scriptedGroups,
+		compat:         compat,
+		scrapes:        &scrapeCounters{},
+		limits:         limits,
+		enabled:        enabled,
+		collectors:     collectors,
+	}
+
+	// the config file wins over the flags
+	if target := settings.target; target != nil {
+		collector.kamailioHost = target.Host
+		collector.kamailioPort = target.Port
+		if target.SocketPath != "" {
+			collector.socketPath = target.SocketPath
+		}
 	}
 
 	// fine, return the created object struct
@@ -136,62 +99,115 @@ func NewStatsCollector(cliContext *cli.Context) (*StatsCollector, error) {
 
 // part of the prometheus.Collector interface
 func (c *StatsCollector) Describe(descriptionChannel chan<- *prometheus.Desc) {
-	// DescribeByCollect is a helper to implement the Describe method of a custom
-	// Collector. It collects the metrics from the provided Collector and sends
-	// their descriptors to the provided channel.
-	prometheus.DescribeByCollect(c, descriptionChannel)
+	// The collector is registered in a new registry for every scrape request,
+	// describing it by collecting would scrape kamailio twice. Sending no descriptions
+	// makes it an "unchecked" collector, its metrics are still checked when they are gathered.
+}
+
+// a copy of the collector running only some of the enabled collectors,
+// all enabled ones if collect is empty, without the excluded ones
+func (c *StatsCollector) filtered(collect []string, exclude []string) (*StatsCollector, error) {
+	if len(collect) == 0 && len(exclude) == 0 {
+		return c, nil
+	}
+	selected := make(map[string]bool)
+	for _, name := range collect {
+		if err := c.checkEnabled(name); err != nil {
+			return nil, err
+		}
+		selected[name] = true
+	}
+	excluded := make(map[string]bool)
+	for _, name := range exclude {
+		if err := c.checkEnabled(name); err != nil {
+			return nil, err
+		}
+		excluded[name] = true
+	}
+
+	filtered := *c
+	filtered.collectors = nil
+	for _, collector := range c.collectors {
+		if (len(collect) == 0 || selected[collector.name]) && !excluded[collector.name] {
+			filtered.collectors = append(filtered.collectors, collector)
+		}
+	}
+	// the remaining stats are only exported if no collectors are selected explicitly
+	if len(collect) > 0 {
+		filtered.catchAll = catchAllOff
+	}
+	return &filtered, nil
+}
+
+func (c *StatsCollector) checkEnabled(name string) error {
+	if !isRegisteredCollector(name) {
+		return fmt.Errorf("unknown collector %q, use one of %s", name, strings.Join(registeredCollectorNames(), ", "))
+	}
+	if !c.enabled[name] {
+		return fmt.Errorf("collector %s is disabled", name)
+	}
+	return nil
 }
 
 // part of the prometheus.Collector interface
 func (c *StatsCollector) Collect(metricChannel chan<- prometheus.Metric) {
-	// read all stats from Kamailio
-	if completeStatMap, err := c.fetchStats(); err == nil {
-		// and produce various prometheus.Metric for well-known stats
-		produceMetrics(completeStatMap, metricChannel)
-		// produce prometheus.Metric objects for scripted stats (if any)
-		convertScriptedMetrics(completeStatMap, metricChannel)
-	} else {
-		// something went wrong
-		// TODO: add a error metric
-		log.Error("Could not fetch values from kamailio", err)
+	// every log line of this scrape carries the same scrape id
+	s := newScrape(c.dial, c.limits)
+	defer s.close()
+	s.log.Debug("Collecting kamailio stats")
+
+	produceCollectorEnabledMetrics(c.enabled, metricChannel)
+	// let every enabled collector produce its metrics
+	var names []string
+	for _, collector := range c.collectors {
+		names = append(names, collector.name)
+		s.startCollector(collector.name)
+		// a failed "stats.fetch" is already reported by statMap
+		if err := collector.collector.Update(s, metricChannel); err != nil && err != s.statsError {
+			// something went wrong
+			// TODO: add a error metric
+			warnLimiter.Errorf(s.log.WithField("collector", collector.name), "collector:"+collector.name,
+				"Collector %s failed: %s", collector.name, err)
+		}
+		s.finishCollector(metricChannel)
+	}
+	if c.compat == compatFlorent {
+		produceFlorentScrapeMetrics(s, c.scrapes, metricChannel)
+	}
+	// and export everything else kamailio reported, if enabled
+	if c.catchAll != catchAllOff {
+		names = append(names, catchAllCollectorName)
+		s.startCollector(catchAllCollectorName)
+		if completeStatMap, err := s.statMap(); err == nil {
+			convertRemainingStats(s, c.catchAll, c.mappings, c.scriptedGroups, completeStatMap, metricChannel)
+		}
+		s.finishCollector(metricChannel)
+	}
+	c.limits.produceMetrics(s.guard, names, metricChannel)
+}
+
+// connect to Kamailio, either via domain socket or tcp
+// logger is the one of the scrape, so the connection is logged with its scrape id
+func (c *StatsCollector) dial(logger *log.Entry) (net.Conn, error) {
+	if c.kamailioHost == "" {
+		logger.Debug("Connecting to kamailio via domain socket ", c.socketPath)
+		return net.Dial("unix", c.socketPath)
 	}
+	address := net.JoinHostPort(c.kamailioHost, strconv.Itoa(c.kamailioPort))
+	logger.Debug("Connecting to kamailio via binrpc ", address)
+	return net.Dial("tcp", address)
 }
 
-// connect to Kamailio and perform a "stats.fetch" rpc call
+// perform a "stats.fetch" rpc call
 // result is a flat key=>value map
-func (c *StatsCollector) fetchStats() (map[string]string, error) {
+func fetchStats(rpc *rpcSession) (map[string]string, error) {
 
 	// TODO measure rpc time
 	//timer := prometheus.NewTimer(rpc_request_duration)
 	//defer timer.ObserveDuration()
 
-	// establish connection to Kamailio server
-	var err error
-	var conn net.Conn
-	if c.kamailioHost == "" {
-		log.Debug("Requesting stats from kamailio via domain socket ", c.socketPath)
-		conn, err = net.Dial("unix", c.socketPath)
-	} else {
-		address := fmt.Sprintf("%s:%d", c.kamailioHost, c.kamailioPort)
-		log.Debug("Requesting stats from kamailio via binrpc ", address)
-		conn, err = net.Dial("tcp", address)
-	}
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	// TODO
-	// c.conn.SetDeadline(time.Now().Add(c.Timeout))
-
-	// WritePacket returns the cookie generated
-	cookie, err := binrpc.WritePacket(conn, "stats.fetch", "all")
-	if err != nil {
-		return nil, err
-	}
-
-	// the cookie is passed again for verification
 	// we receive records in response
-	records, err := binrpc.ReadPacket(conn, cookie)
+	records, err := rpc.call("stats.fetch", "all")
 	if err != nil {
 		return nil, err
 	}
@@ -208,163 +224,32 @@ func (c *StatsCollector) fetchStats() (map[string]string, error) {
 }
 
 // produce a series of prometheus.Metric values by converting "well-known" prometheus stats
-func produceMetrics(completeStatMap map[string]string, metricChannel chan<- prometheus.Metric) {
-
-	// kamailio_core_request_total
-	convertStatToMetric(completeStatMap, "core.drop_requests", "drop", core_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.err_requests", "err", core_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.fwd_requests", "fwd", core_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests", "rcv", core_request_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_core_rcv_request_total
-	convertStatToMetric(completeStatMap, "core.rcv_requests_ack", "ack", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_bye", "bye", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_cancel", "cancel", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_info", "info", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_invite", "invite", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_message", "message", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_notify", "notify", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_options", "options", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_prack", "prack", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_publish", "publish", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_refer", "refer", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_register", "register", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_subscribe", "subscribe", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_requests_update", "update", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.unsupported_methods", "unsupported", core_rcv_request_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_core_reply_total
-	convertStatToMetric(completeStatMap, "core.drop_replies", "drop", core_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.err_replies", "err", core_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.fwd_replies", "fwd", core_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies", "rcv", core_reply_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_core_rcv_reply_total
-	convertStatToMetric(completeStatMap, "core.rcv_replies_18x", "18x", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_1xx", "1xx", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_2xx", "2xx", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_3xx", "3xx", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_401", "401", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_404", "404", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_407", "407", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_408", "408", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_480", "480", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_486", "486", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_4xx", "4xx", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_5xx", "5xx", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.rcv_replies_6xx", "6xx", core_rcv_reply_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_shm_bytes
-	convertStatToMetric(completeStatMap, "shmem.free_size", "free", shmem_bytes, metricChannel, prometheus.GaugeValue)
-	convertStatToMetric(completeStatMap, "shmem.max_used_size", "max_used", shmem_bytes, metricChannel, prometheus.GaugeValue)
-	convertStatToMetric(completeStatMap, "shmem.real_used_size", "real_used", shmem_bytes, metricChannel, prometheus.GaugeValue)
-	convertStatToMetric(completeStatMap, "shmem.total_size", "total", shmem_bytes, metricChannel, prometheus.GaugeValue)
-	convertStatToMetric(completeStatMap, "shmem.used_size", "used", shmem_bytes, metricChannel, prometheus.GaugeValue)
-
-	convertStatToMetric(completeStatMap, "shmem.fragments", "", shmem_fragments, metricChannel, prometheus.GaugeValue)
-	convertStatToMetric(completeStatMap, "dns.failed_dns_request", "", dns_failed, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.bad_URIs_rcvd", "", bad_uri, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "core.bad_msg_hdr", "", bad_msg_hdr, metricChannel, prometheus.CounterValue)
-
-	// kamailio_sl_reply_total
-	convertStatToMetric(completeStatMap, "sl.1xx_replies", "1xx", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.200_replies", "200", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.202_replies", "202", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.2xx_replies", "2xx", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.300_replies", "300", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.301_replies", "301", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.302_replies", "302", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.3xx_replies", "3xx", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.400_replies", "400", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.401_replies", "401", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.403_replies", "403", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.404_replies", "404", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.407_replies", "407", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.408_replies", "408", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.483_replies", "483", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.4xx_replies", "4xx", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.500_replies", "500", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.5xx_replies", "5xx", sl_reply_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.6xx_replies", "6xx", sl_reply_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_sl_type_total
-	convertStatToMetric(completeStatMap, "sl.failures", "failure", sl_type_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.received_ACKs", "received_ack", sl_type_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.sent_err_replies", "sent_err_reply", sl_type_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.sent_replies", "sent_reply", sl_type_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "sl.xxx_replies", "xxx_reply", sl_type_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_tcp_total
-	convertStatToMetric(completeStatMap, "tcp.con_reset", "con_reset", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.con_timeout", "con_timeout", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.connect_failed", "connect_failed", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.connect_success", "connect_success", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.established", "established", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.local_reject", "local_reject", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.passive_open", "passive_open", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.send_timeout", "send_timeout", tcp_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tcp.sendq_full", "sendq_full", tcp_total, metricChannel, prometheus.CounterValue)
-	// kamailio_tcp_connections
-	convertStatToMetric(completeStatMap, "tcp.current_opened_connections", "", tcp_connections, metricChannel, prometheus.GaugeValue)
-	// kamailio_tcp_writequeue
-	convertStatToMetric(completeStatMap, "tcp.current_write_queue_size", "", tcp_writequeue, metricChannel, prometheus.GaugeValue)
-
-	// kamailio_tmx_code_total
-	convertStatToMetric(completeStatMap, "tmx.2xx_transactions", "2xx", tmx_code_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.3xx_transactions", "3xx", tmx_code_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.4xx_transactions", "4xx", tmx_code_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.5xx_transactions", "5xx", tmx_code_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.6xx_transactions", "6xx", tmx_code_total, metricChannel, prometheus.CounterValue)
-	// kamailio_tmx_type_total
-	convertStatToMetric(completeStatMap, "tmx.UAC_transactions", "uac", tmx_type_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.UAS_transactions", "uas", tmx_type_total, metricChannel, prometheus.CounterValue)
-	// kamailio_tmx
-	convertStatToMetric(completeStatMap, "tmx.active_transactions", "active", tmx, metricChannel, prometheus.GaugeValue)
-	convertStatToMetric(completeStatMap, "tmx.inuse_transactions", "inuse", tmx, metricChannel, prometheus.GaugeValue)
-
-	// kamailio_tmx_rpl_total
-	convertStatToMetric(completeStatMap, "tmx.rpl_absorbed", "absorbed", tmx_rpl_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.rpl_generated", "generated", tmx_rpl_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.rpl_received", "received", tmx_rpl_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.rpl_relayed", "relayed", tmx_rpl_total, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "tmx.rpl_sent", "sent", tmx_rpl_total, metricChannel, prometheus.CounterValue)
-
-	// kamailio_dialog
-	convertStatToMetric(completeStatMap, "dialog.active_dialogs", "active_dialogs", dialog, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "dialog.early_dialogs", "early_dialogs", dialog, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "dialog.expired_dialogs", "expired_dialogs", dialog, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "dialog.failed_dialogs", "failed_dialogs", dialog, metricChannel, prometheus.CounterValue)
-	convertStatToMetric(completeStatMap, "dialog.processed_dialogs", "processed_dialogs", dialog, metricChannel, prometheus.CounterValue)
-}
-
-// Iterate all reported "stats" keys and find those with a prefix of "script."
-// These values are user-defined and populated within the kamailio script.
-// See https://www.kamailio.org/docs/modules/5.2.x/modules/statistics.html
-func convertScriptedMetrics(data map[string]string, prom chan<- prometheus.Metric) {
-	for k := range data {
-		// k = "script.custom_total"
-		if strings.HasPrefix(k, "script.") {
-			// metricName = "custom_total"
-			metricName := strings.TrimPrefix(k, "script.")
-			metricName = strings.ToLower(metricName)
-			var valueType prometheus.ValueType
-			// deduce the metrics value type by following https://prometheus.io/docs/practices/naming/
-			if strings.HasSuffix(k, "_total") || strings.HasSuffix(k, "_seconds") || strings.HasSuffix(k, "_bytes") {
-				valueType = prometheus.CounterValue
-			} else {
-				valueType = prometheus.GaugeValue
+// as declared in the mapping file
+func produceMetrics(s *scrape, mappings []*metricMapping, completeStatMap map[string]string, metricChannel chan<- prometheus.Metric) {
+	for _, mapping := range mappings {
+		// remember the label values already produced, a pattern must not repeat them
+		produced := make(map[string]bool)
+		for _, stat := range mapping.stats {
+			if stat.key != "" {
+				convertStatToMetric(s, completeStatMap, stat.key, stat.value, mapping.description, metricChannel, mapping.valueType)
+				produced[stat.value] = true
+				continue
+			}
+			keys, labelValues := stat.matchingStats(completeStatMap)
+			for i, key := range keys {
+				if labelValues[i] == "" || produced[labelValues[i]] {
+					continue
+				}
+				convertStatToMetric(s, completeStatMap, key, labelValues[i], mapping.description, metricChannel, mapping.valueType)
+				produced[labelValues[i]] = true
 			}
-			// create a metric description on the fly
-			description := prometheus.NewDesc("kamailio_"+metricName, "Scripted metric "+metricName, []string{}, nil)
-			// and produce a metric
-			convertStatToMetric(data, k, "", description, prom, valueType)
 		}
 	}
 }
 
 // convert a single "stat" value to a prometheus metric
 // invalid "stat" paires are skipped but logged
-func convertStatToMetric(completeStatMap map[string]string, statKey string, optionalLabelValue string, metricDescription *prometheus.Desc, metricChannel chan<- prometheus.Metric, valueType prometheus.ValueType) {
+func convertStatToMetric(s *scrape, completeStatMap map[string]string, statKey string, optionalLabelValue string, metricDescription *prometheus.Desc, metricChannel chan<- prometheus.Metric, valueType prometheus.ValueType) {
 	// check wether we got a labelValue or not
 	var labelValues []string
 	if optionalLabelValue != "" {
@@ -372,29 +257,77 @@ func convertStatToMetric(completeStatMap map[string]string, statKey string, opti
 	} else {
 		labelValues = []string{}
 	}
+	convertStatToLabelledMetric(s, completeStatMap, statKey, labelValues, metricDescription, metricChannel, valueType)
+}
+
+// same as convertStatToMetric, but for metrics with any number of labels
+func convertStatToLabelledMetric(s *scrape, completeStatMap map[string]string, statKey string, labelValues []string, metricDescription *prometheus.Desc, metricChannel chan<- prometheus.Metric, valueType prometheus.ValueType) {
 	// get the stat-value ...
 	if valueAsString, ok := completeStatMap[statKey]; ok {
+		// remember the stat is taken care of, even if it can't be converted
+		s.exported[statKey] = true
 		// ... convert it to a float
 		if value, err := strconv.ParseFloat(valueAsString, 64); err == nil {
-			// and produce a prometheus metric
-			metric, err := prometheus.NewConstMetric(
-				metricDescription,
-				valueType,
-				value,
-				labelValues...,
-			)
-			if err == nil {
-				// handover the metric to prometheus api
-				metricChannel <- metric
-			} else {
+			// and produce a prometheus metric, handed over to prometheus api
+			if err := s.sendMetric(metricChannel, metricDescription, valueType, value, labelValues...); err != nil {
 				// or skip and complain
-				log.Warnf("Could not convert stat value [%s]: %s", statKey, err)
+				warnLimiter.Warnf(s.log, statKey, "Could not convert stat value [%s]: %s", statKey, err)
 			}
 		}
 	} else {
 		// skip stat values not found in completeStatMap
 		// can happen if some kamailio modules are not loaded
 		// and thus certain stat entries are not created
-		log.Debugf("Skipping stat value [%s], it was not returned by kamailio", statKey)
+		s.skipped = append(s.skipped, statKey)
+	}
+}
+
+// names of all labels the exported metrics may carry, besides the ones of scripted stats
+func (c *StatsCollector) labelNames(settings *exporterSettings) map[string]bool {
+	// the labels of the exporter's own metrics and of histograms
+	names := map[string]bool{"collector": true, "result": true, "with": true, "le": true}
+	if c.catchAll == catchAllLabels {
+		names["group"] = true
+		names["name"] = true
+	}
+	for _, mapping := range c.mappings {
+		if mapping.label != "" {
+			names[mapping.label] = true
+		}
+	}
+	for _, metric := range settings.htables {
+		for _, group := range metric.keyRegex.SubexpNames() {
+			if group != "" {
+				names[group] = true
+			}
+		}
+	}
+	if len(settings.sharedVariables) > 0 {
+		names["name"] = true
+		names["value"] = true
+	}
+	var pushed []*pushMetricConfig
+	if settings.push != nil {
+		for _, metric := range settings.push.Metrics {
+			pushed = append(pushed, metric)
+		}
+	}
+	if settings.evapi != nil {
+		for _, metric := range settings.evapi.Metrics {
+			pushed = append(pushed, metric)
+		}
+	}
+	for _, metric := range pushed {
+		for _, label := range metric.Labels {
+			names[label] = true
+		}
+	}
+	if settings.statsd != nil {
+		for _, mapping := range settings.statsd.Mappings {
+			for label := range mapping.Labels {
+				names[label] = true
+			}
+		}
 	}
+	return names
 }
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// a statsd listener receiving the packets of kamailio's statsd module, declared in the config file
+// See https://www.kamailio.org/docs/modules/5.2.x/modules/statsd.html
+type statsdConfig struct {
+	// the udp address to listen on, ":9125" if omitted
+	ListenAddress string `yaml:"listen_address"`
+	// upper bounds of the histogram buckets of timers in seconds, the prometheus default buckets if omitted
+	TimerBuckets []float64 `yaml:"timer_buckets"`
+	// maximum number of series, further samples are rejected, 0 means unlimited
+	SeriesLimit int                    `yaml:"series_limit"`
+	Mappings    []*statsdMappingConfig `yaml:"mappings"`
+}
+
+// maps statsd names to a metric name and labels, the first matching mapping wins
+type statsdMappingConfig struct {
+	// dot-separated name, "*" matches a single part, e.g. "carrier.*.calls"
+	Match string `yaml:"match"`
+	// the metric name without "kamailio_", ${1} refers to the part matched by the first "*"
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	// label names and their values, e.g. {carrier: $1}
+	Labels map[string]string `yaml:"labels"`
+	// the histogram buckets of timers, timer_buckets if omitted
+	Buckets []float64 `yaml:"buckets"`
+}
+
+const defaultStatsdListenAddress = ":9125"
+
+// results of kamailio_exporter_statsd_samples_total
+const (
+	statsdAccepted = "accepted"
+	statsdInvalid  = "invalid"
+	statsdLimited  = "limited"
+	// negative counter samples, e.g. "calls:-1|c" of statsd_decr, prometheus counters can't decrease
+	statsdDecrement = "decrement"
+)
+
+var statsdSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kamailio_exporter_statsd_samples_total",
+	Help: "Samples received by the statsd listener, by result",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(statsdSamples)
+}
+
+func checkStatsdConfig(config *statsdConfig) error {
+	if config.ListenAddress == "" {
+		config.ListenAddress = defaultStatsdListenAddress
+	}
+	if _, _, err := net.SplitHostPort(config.ListenAddress); err != nil {
+		return fmt.Errorf("invalid listen_address %q: %s", config.ListenAddress, err)
+	}
+	if err := checkBuckets(config.TimerBuckets); err != nil {
+		return fmt.Errorf("timer_buckets: %s", err)
+	}
+	if config.SeriesLimit < 0 {
+		return fmt.Errorf("series_limit must not be negative")
+	}
+	for i, mapping := range config.Mappings {
+		if _, err := newStatsdMapping(mapping); err != nil {
+			return fmt.Errorf("mappings #%d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+func checkBuckets(buckets []float64) error {
+	for i, bound := range buckets {
+		if i > 0 && bound <= buckets[i-1] {
+			return fmt.Errorf("buckets must be in increasing order")
+		}
+	}
+	return nil
+}
+
+// a validated statsd mapping
+type statsdMapping struct {
+	config     *statsdMappingConfig
+	match      *regexp.Regexp
+	labelNames []string
+}
+
+func newStatsdMapping(config *statsdMappingConfig) (*statsdMapping, error) {
+	if config.Match == "" {
+		return nil, fmt.Errorf("match is missing")
+	}
+	parts := strings.Split(config.Match, ".")
+	for i, part := range parts {
+		if part == "*" {
+			parts[i] = `([^.]+)`
+		} else {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+	}
+	match := regexp.MustCompile("^" + strings.Join(parts, `\.`) + "$")
+	if config.Name == "" {
+		return nil, fmt.Errorf("name is missing")
+	}
+	// the name is checked once the captures are known
+	var labelNames []string
+	for label := range config.Labels {
+		if !labelNameRegexp.MatchString(label) || strings.HasPrefix(label, "__") || label == "le" {
+			return nil, fmt.Errorf("invalid label name %q", label)
+		}
+		labelNames = append(labelNames, label)
+	}
+	sort.Strings(labelNames)
+	if err := checkBuckets(config.Buckets); err != nil {
+		return nil, err
+	}
+	return &statsdMapping{config: config, match: match, labelNames: labelNames}, nil
+}
+
+// a sample of a statsd packet, e.g. "calls:1|c" or "setup:830|ms"
+type statsdSample struct {
+	name string
+	// c, g, ms or h
+	kind  string
+	value float64
+	// gauges can be changed relatively, e.g. "active:+1|g"
+	relative bool
+}
+
+// parse a line of a statsd packet: <name>:<value>|<type>[|@<sample rate>]
+func parseStatsdSample(line string) (*statsdSample, error) {
+	colon := strings.LastIndex(line, ":")
+	if colon <= 0 {
+		return nil, fmt.Errorf("name or value is missing")
+	}
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("type is missing")
+	}
+	sample := &statsdSample{name: line[:colon], kind: fields[1]}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[0])
+	}
+	sample.value = value
+	switch sample.kind {
+	case "c":
+		// a counter sampled at a rate of 0.1 counts 10 times
+		for _, field := range fields[2:] {
+			if strings.HasPrefix(field, "@") {
+				rate, err := strconv.ParseFloat(field[1:], 64)
+				if err != nil || rate <= 0 || rate > 1 {
+					return nil, fmt.Errorf("invalid sample rate %q", field)
+				}
+				sample.value /= rate
+			}
+		}
+	case "g":
+		sample.relative = strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-")
+	case "ms", "h":
+	default:
+		return nil, fmt.Errorf("unsupported type %q", sample.kind)
+	}
+	return sample, nil
+}
+
+// a metric fed by statsd samples
+type statsdMetric struct {
+	kind       string
+	labelNames string
+	// a CounterVec, GaugeVec or HistogramVec
+	vec prometheus.Collector
+}
+
+// the metrics received so far
+type statsdStore struct {
+	config   *statsdConfig
+	mappings []*statsdMapping
+
+	mu      sync.Mutex
+	metrics map[string]*statsdMetric
+	series  map[string]bool
+	// names of the default registry, gathered when the store is created
+	registryNames map[string]bool
+}
+
+func newStatsdStore(config *statsdConfig) *statsdStore {
+	store := &statsdStore{
+		config:        config,
+		metrics:       make(map[string]*statsdMetric),
+		series:        make(map[string]bool),
+		registryNames: defaultRegistryNames(),
+	}
+	for _, mappingConfig := range config.Mappings {
+		// already validated
+		mapping, _ := newStatsdMapping(mappingConfig)
+		store.mappings = append(store.mappings, mapping)
+	}
+	return store
+}
+
+// the metric name, help text, label values and buckets of a sample
+func (s *statsdStore) resolve(sample *statsdSample) (string, string, []string, []string, []float64) {
+	for _, mapping := range s.mappings {
+		captures := mapping.match.FindStringSubmatchIndex(sample.name)
+		if captures == nil {
+			continue
+		}
+		expand := func(template string) string {
+			return string(mapping.match.ExpandString(nil, template, sample.name, captures))
+		}
+		labelValues := make([]string, len(mapping.labelNames))
+		for i, label := range mapping.labelNames {
+			labelValues[i] = expand(mapping.config.Labels[label])
+		}
+		help := mapping.config.Help
+		if help == "" {
+			help = "Statsd metric " + mapping.config.Match
+		}
+		buckets := mapping.config.Buckets
+		if buckets == nil {
+			buckets = s.config.TimerBuckets
+		}
+		return "kamailio_" + sanitizeMetricName(expand(mapping.config.Name)), help, mapping.labelNames, labelValues, buckets
+	}
+
+	// unmapped names follow the prometheus naming conventions
+	name := "kamailio_" + sanitizeMetricName(sample.name)
+	switch sample.kind {
+	case "c":
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+	case "ms":
+		if !strings.HasSuffix(name, "_seconds") {
+			name += "_seconds"
+		}
+	}
+	return name, "Statsd metric " + sample.name, nil, nil, s.config.TimerBuckets
+}
+
+// apply a sample to its metric, which is created on first use
+func (s *statsdStore) observe(sample *statsdSample) (string, error) {
+	name, help, labelNames, labelValues, buckets := s.resolve(sample)
+	if !metricNameRegexp.MatchString(name) || name == "kamailio_" {
+		return statsdInvalid, fmt.Errorf("invalid metric name %q", name)
+	}
+	kind := "histogram"
+	switch sample.kind {
+	case "c":
+		if sample.value < 0 {
+			return statsdDecrement, fmt.Errorf("decrements of counters are not supported, use a gauge")
+		}
+		kind = "counter"
+	case "g":
+		kind = "gauge"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	joinedLabelNames := strings.Join(labelNames, ",")
+	metric, ok := s.metrics[name]
+	if !ok {
+		if isDefaultRegistryMetric(s.registryNames, name) {
+			return statsdInvalid, fmt.Errorf("metric %s collides with a metric of the exporter", name)
+		}
+		metric = &statsdMetric{kind: kind, labelNames: joinedLabelNames}
+		switch kind {
+		case "counter":
+			metric.vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+		case "gauge":
+			metric.vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)
+		default:
+			metric.vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)
+		}
+	} else if metric.kind != kind || metric.labelNames != joinedLabelNames {
+		return statsdInvalid, fmt.Errorf("metric %s is already a %s with the labels [%s]", name, metric.kind, metric.labelNames)
+	}
+
+	series := histogramKey(name, labelValues)
+	if !s.series[series] {
+		if s.config.SeriesLimit > 0 && len(s.series) >= s.config.SeriesLimit {
+			return statsdLimited, fmt.Errorf("the series limit of %d is reached", s.config.SeriesLimit)
+		}
+		s.series[series] = true
+	}
+	s.metrics[name] = metric
+
+	switch vec := metric.vec.(type) {
+	case *prometheus.CounterVec:
+		vec.WithLabelValues(labelValues...).Add(sample.value)
+	case *prometheus.GaugeVec:
+		if sample.relative {
+			vec.WithLabelValues(labelValues...).Add(sample.value)
+		} else {
+			vec.WithLabelValues(labelValues...).Set(sample.value)
+		}
+	case *prometheus.HistogramVec:
+		value := sample.value
+		if sample.kind == "ms" {
+			value /= 1000
+		}
+		vec.WithLabelValues(labelValues...).Observe(value)
+	}
+	return statsdAccepted, nil
+}
+
+// the metrics sorted by name
+func (s *statsdStore) sortedMetrics() ([]string, []*statsdMetric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]*statsdMetric, len(names))
+	for i, name := range names {
+		metrics[i] = s.metrics[name]
+	}
+	return names, metrics
+}
+
+// receives statsd packets until stopped
+type statsdListener struct {
+	address string
+	conn    net.PacketConn
+	log     *log.Entry
+	done    chan struct{}
+
+	// replaced if the configuration changes, but not the address
+	mu    sync.Mutex
+	store *statsdStore
+}
+
+var (
+	// the running listener, replaced when the configuration changes
+	statsdMu      sync.Mutex
+	statsdRunning *statsdListener
+)
+
+// start, replace or stop the listener according to the current configuration,
+// a nil config stops it. The received metrics are kept unless the configuration changes,
+// the current listener keeps running if the new address can't be used.
+func configureStatsd(config *statsdConfig) error {
+	statsdMu.Lock()
+	defer statsdMu.Unlock()
+	if running := statsdRunning; running != nil && config != nil && running.address == config.ListenAddress {
+		if store := running.currentStore(); !reflect.DeepEqual(store.config, config) {
+			running.mu.Lock()
+			running.store = newStatsdStore(config)
+			running.mu.Unlock()
+		}
+		return nil
+	}
+
+	var conn net.PacketConn
+	if config != nil {
+		var err error
+		if conn, err = net.ListenPacket("udp", config.ListenAddress); err != nil {
+			return fmt.Errorf("statsd listener: %s", err)
+		}
+	}
+	if statsdRunning != nil {
+		statsdRunning.close()
+		statsdRunning = nil
+	}
+	if config == nil {
+		return nil
+	}
+	statsdRunning = &statsdListener{
+		address: config.ListenAddress,
+		conn:    conn,
+		log:     log.WithField("statsd", config.ListenAddress),
+		done:    make(chan struct{}),
+		store:   newStatsdStore(config),
+	}
+	go statsdRunning.run()
+	statsdRunning.log.Info("Listening for statsd packets")
+	return nil
+}
+
+// the metrics of the running listener, nil if there is none
+func runningStatsdStore() *statsdStore {
+	statsdMu.Lock()
+	defer statsdMu.Unlock()
+	if statsdRunning == nil {
+		return nil
+	}
+	return statsdRunning.currentStore()
+}
+
+func (l *statsdListener) currentStore() *statsdStore {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store
+}
+
+func (l *statsdListener) run() {
+	defer close(l.done)
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			// closed by close()
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				l.handle(line)
+			}
+		}
+	}
+}
+
+func (l *statsdListener) handle(line string) {
+	sample, err := parseStatsdSample(line)
+	result := statsdInvalid
+	if err == nil {
+		result, err = l.currentStore().observe(sample)
+	}
+	statsdSamples.WithLabelValues(result).Inc()
+	if err != nil {
+		warnLimiter.Warnf(l.log, "statsd:"+result, "Skipping statsd sample %q: %s", line, err)
+	}
+}
+
+// stop the listener and wait for it
+func (l *statsdListener) close() {
+	l.conn.Close()
+	<-l.done
+	l.log.Info("Stopped listening for statsd packets")
+}
+
+// a collector producing the metrics received by the statsd listener
+type statsdCollector struct {
+	// names of the built-in metrics, statsd metrics must not use them
+	builtinNames map[string]bool
+}
+
+func newStatsdCollector(config *collectorConfig) (Collector, error) {
+	builtinNames := make(map[string]bool)
+	for _, mapping := range config.mappings {
+		builtinNames[mapping.name] = true
+	}
+	for _, name := range exporterMetricNames {
+		builtinNames[name] = true
+	}
+	for name := range defaultRegistryNames() {
+		builtinNames[name] = true
+	}
+	return &statsdCollector{builtinNames: builtinNames}, nil
+}
+
+func (c *statsdCollector) Update(s *scrape, metricChannel chan<- prometheus.Metric) error {
+	store := runningStatsdStore()
+	if store == nil {
+		return nil
+	}
+	names, metrics := store.sortedMetrics()
+	for i, name := range names {
+		if c.builtinNames[name] {
+			warnLimiter.Warnf(s.log, "statsd:"+name, "Skipping statsd metric %s, it collides with a built-in metric", name)
+			continue
+		}
+		if producer, ok := s.names[name]; ok {
+			warnLimiter.Warnf(s.log, "statsd:"+name, "Skipping statsd metric %s, it is already produced by %s", name, producer)
+			continue
+		}
+		s.names[name] = "statsd listener"
+		// the series limit of the listener applies instead of those of the collectors
+		metrics[i].vec.Collect(metricChannel)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStatsdStoreRejectsExporterMetrics(t *testing.T) {
+	store := newStatsdStore(&statsdConfig{})
+	for _, line := range []string{"exporter_evapi_connected:1|g", "exporter_anything:1|c"} {
+		sample, err := parseStatsdSample(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := store.observe(sample); result != statsdInvalid || err == nil {
+			t.Errorf("%s: got %s %v, want it to be invalid", line, result, err)
+		}
+	}
+	sample, _ := parseStatsdSample("active_calls:3|g")
+	if result, err := store.observe(sample); result != statsdAccepted {
+		t.Errorf("active_calls: got %s %v, want it to be accepted", result, err)
+	}
+}
+
+func TestParseStatsdSample(t *testing.T) {
+	tests := []struct {
+		line     string
+		name     string
+		kind     string
+		value    float64
+		relative bool
+	}{
+		{"calls:1|c", "calls", "c", 1, false},
+		{"calls:1|c|@0.1", "calls", "c", 10, false},
+		{"calls:-1|c", "calls", "c", -1, false},
+		{"active:3|g", "active", "g", 3, false},
+		{"active:+1|g", "active", "g", 1, true},
+		{"active:-2|g", "active", "g", -2, true},
+		{"setup:830|ms", "setup", "ms", 830, false},
+		{"size:1.5|h", "size", "h", 1.5, false},
+		// the value follows the last colon
+		{"sip:invite:1|c", "sip:invite", "c", 1, false},
+	}
+	for _, test := range tests {
+		sample, err := parseStatsdSample(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if sample.name != test.name || sample.kind != test.kind || sample.value != test.value || sample.relative != test.relative {
+			t.Errorf("%s: got %+v", test.line, sample)
+		}
+	}
+}
+
+func TestParseStatsdSampleErrors(t *testing.T) {
+	for _, line := range []string{"calls", ":1|c", "calls:1", "calls:x|c", "calls:1|s", "calls:1|c|@0", "calls:1|c|@2", "calls:1|c|@x"} {
+		if sample, err := parseStatsdSample(line); err == nil {
+			t.Errorf("%s: got %+v, want an error", line, sample)
+		}
+	}
+}
+
+func TestStatsdStoreDecrement(t *testing.T) {
+	store := newStatsdStore(&statsdConfig{})
+	sample, _ := parseStatsdSample("calls:-1|c")
+	if result, err := store.observe(sample); result != statsdDecrement || err == nil {
+		t.Errorf("got %s %v, want a decrement", result, err)
+	}
+	if names, _ := store.sortedMetrics(); len(names) != 0 {
+		t.Errorf("got metrics %v for a decrement", names)
+	}
+}
+
+func TestStatsdStoreResolve(t *testing.T) {
+	mapping := &statsdMappingConfig{Match: "carrier.*.calls", Name: "carrier_calls_total", Labels: map[string]string{"carrier": "$1"}}
+	store := newStatsdStore(&statsdConfig{Mappings: []*statsdMappingConfig{mapping}})
+	tests := []struct {
+		line        string
+		name        string
+		labelValues []string
+	}{
+		{"carrier.a.calls:1|c", "kamailio_carrier_calls_total", []string{"a"}},
+		{"carrier.a.b.calls:1|c", "kamailio_carrier_a_b_calls_total", nil},
+		{"Invite-Time:230|ms", "kamailio_invite_time_seconds", nil},
+		{"calls_total:1|c", "kamailio_calls_total", nil},
+		{"active:1|g", "kamailio_active", nil},
+	}
+	for _, test := range tests {
+		sample, err := parseStatsdSample(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, _, _, labelValues, _ := store.resolve(sample)
+		if name != test.name || len(labelValues) != len(test.labelValues) || (len(labelValues) > 0 && labelValues[0] != test.labelValues[0]) {
+			t.Errorf("%s: got %s %v, want %s %v", test.line, name, labelValues, test.name, test.labelValues)
+		}
+	}
+}
+
+func TestStatsdStoreSeriesLimit(t *testing.T) {
+	store := newStatsdStore(&statsdConfig{SeriesLimit: 2})
+	// the names of the default registry are gathered once, when the store is created
+	store.registryNames = map[string]bool{"kamailio_go_goroutines": true}
+	tests := []struct {
+		line   string
+		result string
+	}{
+		{"calls:1|c", statsdAccepted},
+		{"active:3|g", statsdAccepted},
+		// the limit is reached, known series are still updated
+		{"calls:2|c", statsdAccepted},
+		{"active:+1|g", statsdAccepted},
+		{"failed:1|c", statsdLimited},
+		{"setup:830|ms", statsdLimited},
+		// rejected names stay invalid
+		{"go_goroutines:1|g", statsdInvalid},
+		{"exporter_scrapes:1|c", statsdInvalid},
+	}
+	for _, test := range tests {
+		sample, err := parseStatsdSample(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := store.observe(sample); result != test.result {
+			t.Errorf("%s: got %s %v, want %s", test.line, result, err, test.result)
+		}
+	}
+	if len(store.series) != 2 || len(store.metrics) != 2 {
+		t.Errorf("got series %v, want calls and active only", store.series)
+	}
+}